@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type accessLogKey struct{}
+
+// accessLogEntry collects what a request did, handlers deeper down fill in
+// the user and the uploaded file name.
+type accessLogEntry struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Protocol string    `json:"protocol"`
+	Method   string    `json:"method"`
+	URI      string    `json:"uri"`
+	Status   int       `json:"status"`
+	Bytes    int64     `json:"bytes"`
+	Duration float64   `json:"duration_ms"`
+	User     string    `json:"user,omitempty"`
+	Upload   string    `json:"upload,omitempty"`
+	Referer  string    `json:"referer,omitempty"`
+	Agent    string    `json:"user_agent,omitempty"`
+
+	proto string
+}
+
+var (
+	accessLogger io.Writer
+)
+
+// rotatingFile is an append-only log file which is renamed to name.1,
+// name.2, ... once it grows beyond maxSize.
+type rotatingFile struct {
+	mu      sync.Mutex
+	name    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+}
+
+func newRotatingFile(name string, maxSize int64, backups int) (*rotatingFile, error) {
+	rf := &rotatingFile{name: name, maxSize: maxSize, backups: backups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.file = f
+	rf.size = fi.Size()
+	return nil
+}
+
+func (rf *rotatingFile) rotate() error {
+	rf.file.Close()
+	shiftBackups(rf.name, rf.backups)
+	return rf.open()
+}
+
+// shiftBackups renames name to name.1, name.1 to name.2 and so on, keeping
+// at most backups old files.
+func shiftBackups(name string, backups int) {
+	for i := backups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", name, i), fmt.Sprintf("%s.%d", name, i+1))
+	}
+	if backups > 0 {
+		os.Rename(name, name+".1")
+	} else {
+		os.Remove(name)
+	}
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.maxSize > 0 && rf.size+int64(len(p)) > rf.maxSize && rf.size > 0 {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// openAccessLog sets up the --accessLog destination, "-" is stdout.
+func openAccessLog() error {
+	switch accessLogFormat {
+	case "common", "combined", "json":
+	default:
+		return fmt.Errorf("unsupported access log format %s, candidates: common, combined, json", accessLogFormat)
+	}
+	if accessLogPath == "-" {
+		accessLogger = os.Stdout
+		return nil
+	}
+	rf, err := newRotatingFile(accessLogPath, accessLogMaxSize*1024*1024, accessLogBackups)
+	if err != nil {
+		return err
+	}
+	accessLogger = rf
+	return nil
+}
+
+// recordingResponseWriter records status and size of a response for the
+// access log and metrics. Hijacked connections, like CONNECT tunnels in proxy
+// mode, are counted as well.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status   int
+	sent     atomic.Int64
+	received atomic.Int64
+}
+
+type countingConn struct {
+	net.Conn
+	sent     *atomic.Int64
+	received *atomic.Int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.received.Add(int64(n))
+	return n, err
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.sent.Add(int64(n))
+	return n, err
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.sent.Add(int64(n))
+	return n, err
+}
+
+func (w *recordingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *recordingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, rw, err := h.Hijack()
+	if err != nil {
+		return conn, rw, err
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	conn = countingConn{Conn: conn, sent: &w.sent, received: &w.received}
+	rw.Writer.Flush()
+	rw.Writer.Reset(conn)
+	return conn, rw, nil
+}
+
+func (w *recordingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func protocolName(r *http.Request) string {
+	switch r.ProtoMajor {
+	case 3:
+		return "h3"
+	case 2:
+		return "h2"
+	}
+	return "h1"
+}
+
+// withAccessLog logs every request served by h when --accessLog is given.
+func withAccessLog(h http.Handler) http.Handler {
+	if accessLogger == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry := &accessLogEntry{
+			Time:     time.Now(),
+			Client:   r.RemoteAddr,
+			Protocol: protocolName(r),
+			Method:   r.Method,
+			URI:      r.RequestURI,
+			Referer:  r.Referer(),
+			Agent:    r.UserAgent(),
+			proto:    r.Proto,
+		}
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			entry.Client = host
+		}
+		lw := &recordingResponseWriter{ResponseWriter: w}
+		r = r.WithContext(context.WithValue(r.Context(), accessLogKey{}, entry))
+
+		h.ServeHTTP(lw, r)
+
+		entry.Status = lw.status
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		entry.Bytes = lw.sent.Load()
+		entry.Duration = float64(time.Since(entry.Time).Microseconds()) / 1000
+		writeAccessLog(entry)
+	})
+}
+
+func writeAccessLog(entry *accessLogEntry) {
+	var line string
+	switch accessLogFormat {
+	case "json":
+		b, _ := json.Marshal(entry)
+		line = string(b)
+	default:
+		line = fmt.Sprintf(`%s - %s [%s] "%s %s %s" %d %d`,
+			entry.Client, dashIfEmpty(entry.User), entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			entry.Method, entry.URI, entry.proto, entry.Status, entry.Bytes)
+		if accessLogFormat == "combined" {
+			line += fmt.Sprintf(` "%s" "%s"`, dashIfEmpty(entry.Referer), dashIfEmpty(entry.Agent))
+		}
+	}
+	io.WriteString(accessLogger, line+"\n")
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.ReplaceAll(s, `"`, `\"`)
+}
+
+// setAccessLogUser records the user of r once its credentials were
+// accepted, requests without valid ones are logged without a user.
+func setAccessLogUser(r *http.Request, user string) {
+	if entry, ok := r.Context().Value(accessLogKey{}).(*accessLogEntry); ok {
+		entry.User = user
+	}
+}
+
+func setAccessLogUpload(r *http.Request, fileName string) {
+	if entry, ok := r.Context().Value(accessLogKey{}).(*accessLogEntry); ok {
+		entry.Upload = fileName
+	}
+}
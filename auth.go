@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// checkBasicAuth verifies the Basic credentials of r against the --user flag
+// and returns the authenticated user name.
+func checkBasicAuth(r *http.Request) (string, bool) {
+	basicAuth := access.Load().basicAuth
+	if basicAuth == "" {
+		return "", false
+	}
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	expectedUser, expectedPass, _ := strings.Cut(basicAuth, ":")
+	userMatch := subtle.ConstantTimeCompare([]byte(user), []byte(expectedUser)) == 1
+	passMatch := subtle.ConstantTimeCompare([]byte(pass), []byte(expectedPass)) == 1
+	if !userMatch || !passMatch {
+		return "", false
+	}
+	return user, true
+}
+
+// requireAuth only lets requests with valid credentials reach h. Without any
+// configured credential the endpoint is disabled entirely.
+func requireAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if access.Load().basicAuth == "" {
+			http.Error(w, "file management is disabled, start server with --user", http.StatusForbidden)
+			return
+		}
+		user, ok := checkBasicAuth(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="transfer"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		setAccessLogUser(r, user)
+		h(w, r)
+	}
+}
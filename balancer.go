@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	balanceRoundRobin = "rr"
+	balanceLeastConn  = "leastconn"
+	balanceWeighted   = "weighted"
+)
+
+// backend is one target of a relay port mapping.
+type backend struct {
+	target *url.URL
+	weight int
+	active atomic.Int64
+	pool   *balancer
+	// smooth weighted round-robin state, guarded by balancer.mu
+	current int
+	health  backendHealth
+}
+
+// balancer spreads the requests of one relay port mapping over its backends
+// with --relayStrategy.
+type balancer struct {
+	mu       sync.Mutex
+	strategy string
+	backends []*backend
+	next     int
+	// tcp or udp for plain port forwarding, empty for HTTP
+	forward string
+	// the mapping the balancer serves, labels transfer_relay_backend_up
+	port  string
+	route string
+}
+
+func isBalanceStrategy(s string) bool {
+	switch s {
+	case balanceRoundRobin, balanceLeastConn, balanceWeighted:
+		return true
+	}
+	return false
+}
+
+// newBalancer parses comma separated targets, each optionally weighted with
+// a #weight=N suffix, for example http://a:8080#weight=3,http://b:8080.
+func newBalancer(targets, strategy string) (*balancer, error) {
+	if !isBalanceStrategy(strategy) {
+		return nil, fmt.Errorf("unsupported relay strategy %s, candidates: rr, leastconn, weighted", strategy)
+	}
+	b := &balancer{strategy: strategy}
+	for _, s := range strings.Split(targets, ",") {
+		u, err := url.Parse(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid relay target %s", s)
+		}
+		be := &backend{target: u, weight: 1, pool: b}
+		if u.Fragment != "" {
+			w, ok := strings.CutPrefix(u.Fragment, "weight=")
+			if be.weight, err = strconv.Atoi(w); !ok || err != nil || be.weight < 1 {
+				return nil, fmt.Errorf("invalid relay target %s, expected #weight=<positive number>", s)
+			}
+			u.Fragment = ""
+		}
+		forward := ""
+		if u.Scheme == forwardTCP || u.Scheme == forwardUDP {
+			if u.Port() == "" {
+				return nil, fmt.Errorf("invalid relay target %s, a port is required", s)
+			}
+			forward = u.Scheme
+		}
+		if len(b.backends) == 0 {
+			b.forward = forward
+		} else if forward != b.forward {
+			return nil, fmt.Errorf("relay targets %s mix HTTP, tcp:// and udp://", targets)
+		}
+		b.backends = append(b.backends, be)
+	}
+	return b, nil
+}
+
+// pick chooses the backend for the next request among the healthy ones, it
+// returns nil when there is none.
+func (b *balancer) pick() *backend {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	n := len(b.backends)
+	switch b.strategy {
+	case balanceLeastConn:
+		// fewest requests in flight relative to the weight, ties are broken
+		// round-robin so that an idle pool is still spread
+		var best *backend
+		for i := 0; i < n; i++ {
+			be := b.backends[(b.next+i)%n]
+			if !be.available(now) {
+				continue
+			}
+			if best == nil || be.active.Load()*int64(best.weight) < best.active.Load()*int64(be.weight) {
+				best = be
+			}
+		}
+		b.next = (b.next + 1) % n
+		return best
+	case balanceWeighted:
+		// smooth weighted round-robin as done by nginx, a:5 b:1 c:1 goes
+		// a a b a c a a instead of a a a a a b c
+		var best *backend
+		total := 0
+		for _, be := range b.backends {
+			if !be.available(now) {
+				continue
+			}
+			be.current += be.weight
+			total += be.weight
+			if best == nil || be.current > best.current {
+				best = be
+			}
+		}
+		if best != nil {
+			best.current -= total
+		}
+		return best
+	}
+	for i := 0; i < n; i++ {
+		be := b.backends[b.next]
+		b.next = (b.next + 1) % n
+		if be.available(now) {
+			return be
+		}
+	}
+	return nil
+}
+
+// othersAvailable reports whether a backend other than be takes requests.
+func (b *balancer) othersAvailable(be *backend) bool {
+	now := time.Now()
+	for _, other := range b.backends {
+		if other != be && other.available(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// pickedBackendKey holds the backend the relay picked for a request, nil
+// when none was available.
+type pickedBackendKey struct{}
+
+// withPickedBackend records be for balancerTransport.
+func withPickedBackend(req *http.Request, be *backend) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), pickedBackendKey{}, be))
+}
+
+// balancerTransport counts the requests in flight per backend until their
+// response bodies are done. Requests go nowhere but to the backend picked
+// for them, whatever their URL says.
+type balancerTransport struct {
+	http.RoundTripper
+}
+
+func (t balancerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	be, _ := req.Context().Value(pickedBackendKey{}).(*backend)
+	if be == nil {
+		return nil, errNoBackend
+	}
+	be.active.Add(1)
+	resp, err := t.RoundTripper.RoundTrip(req)
+	recordBackendResult(be, resp, err)
+	if err != nil {
+		be.active.Add(-1)
+		return nil, err
+	}
+	body := &doneReadCloser{ReadCloser: resp.Body, done: func() { be.active.Add(-1) }}
+	if w, ok := resp.Body.(io.Writer); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+		// httputil.ReverseProxy needs to write to upgraded connections
+		resp.Body = struct {
+			*doneReadCloser
+			io.Writer
+		}{body, w}
+	} else {
+		resp.Body = body
+	}
+	return resp, nil
+}
+
+// doneReadCloser calls done once when the body is closed.
+type doneReadCloser struct {
+	io.ReadCloser
+	done func()
+	once sync.Once
+}
+
+func (r *doneReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.done)
+	return err
+}
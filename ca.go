@@ -0,0 +1,217 @@
+package main
+
+import (
+	"container/list"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-httpproxy/httpproxy"
+)
+
+const (
+	defaultCACertFile = "ca.pem"
+	defaultCAKeyFile  = "ca-key.pem"
+	leafCertValidity  = 30 * 24 * time.Hour
+	leafCertCacheSize = 1024
+)
+
+// generateCA creates a new root CA for MITM in proxy mode and stores it in
+// --caCert and --caKey, existing files are never overwritten.
+func generateCA() error {
+	certPath := ternaryOp(caCertFile == "", defaultCACertFile, caCertFile)
+	keyPath := ternaryOp(caKeyFile == "", defaultCAKeyFile, caKeyFile)
+	for _, p := range []string{certPath, keyPath} {
+		if _, err := os.Stat(p); err == nil {
+			return fmt.Errorf("%s already exists, remove it first to generate a new CA", p)
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   "Transfer Proxy CA " + hostname,
+			Organization: []string{"Transfer Proxy"},
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	if err = os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return err
+	}
+
+	logStdout.Printf("Generated CA certificate %s and key %s, keep the key private.\n", certPath, keyPath)
+	logStdout.Println("Trust the certificate on the machines whose traffic is intercepted:")
+	logStdout.Printf("\tmacOS:   sudo security add-trusted-cert -d -r trustRoot -k /Library/Keychains/System.keychain %s\n", certPath)
+	logStdout.Printf("\tDebian:  sudo cp %s /usr/local/share/ca-certificates/transfer-ca.crt && sudo update-ca-certificates\n", certPath)
+	logStdout.Printf("\tFedora:  sudo trust anchor --store %s\n", certPath)
+	logStdout.Printf("\tWindows: certutil -addstore -f ROOT %s\n", certPath)
+	logStdout.Println("\tFirefox keeps its own store, import it in Settings > Privacy & Security > Certificates.")
+	logStdout.Printf("Then start the proxy with: transfer -m proxy --caCert %s --caKey %s\n", certPath, keyPath)
+	return nil
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// leafSigner mints certificates for intercepted hosts, signed by the proxy
+// CA and cached per host.
+type leafSigner struct {
+	ca     tls.Certificate
+	caCert *x509.Certificate
+
+	mu    sync.Mutex
+	certs map[string]*list.Element
+	lru   *list.List
+}
+
+type leafEntry struct {
+	host string
+	cert *tls.Certificate
+}
+
+var (
+	mitmSigner *leafSigner
+)
+
+// loadCA reads --caCert and --caKey, the CA bundled with httpproxy is only
+// used when neither is given.
+func loadCA() error {
+	var (
+		ca  tls.Certificate
+		err error
+	)
+	switch {
+	case caCertFile == "" && caKeyFile == "":
+		logStderr.Println("WARN: Proxy: intercepting TLS with the publicly known httpproxy CA, run -m genca to create your own.")
+		ca, err = tls.X509KeyPair(httpproxy.DefaultCaCert, httpproxy.DefaultCaKey)
+	case caCertFile == "" || caKeyFile == "":
+		return errors.New("--caCert and --caKey must be given together")
+	default:
+		ca, err = tls.LoadX509KeyPair(caCertFile, caKeyFile)
+	}
+	if err != nil {
+		return err
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return err
+	}
+	if !caCert.IsCA {
+		return errors.New("proxy CA certificate is not a CA")
+	}
+	mitmSigner = &leafSigner{ca: ca, caCert: caCert, certs: make(map[string]*list.Element), lru: list.New()}
+	return nil
+}
+
+// certificate returns the cached certificate for host, minting a new one
+// when there is none or it is about to expire.
+func (s *leafSigner) certificate(host string) (*tls.Certificate, error) {
+	s.mu.Lock()
+	if e, ok := s.certs[host]; ok {
+		entry := e.Value.(*leafEntry)
+		if time.Until(entry.cert.Leaf.NotAfter) > time.Hour {
+			s.lru.MoveToFront(e)
+			s.mu.Unlock()
+			return entry.cert, nil
+		}
+	}
+	s.mu.Unlock()
+
+	cert, err := s.sign(host)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.certs[host]; ok {
+		s.lru.Remove(e)
+	}
+	s.certs[host] = s.lru.PushFront(&leafEntry{host: host, cert: cert})
+	if s.lru.Len() > leafCertCacheSize {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.certs, oldest.Value.(*leafEntry).host)
+	}
+	return cert, nil
+}
+
+func (s *leafSigner) sign(host string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	notAfter := now.Add(leafCertValidity)
+	if notAfter.After(s.caCert.NotAfter) {
+		notAfter = s.caCert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, s.caCert, &key.PublicKey, s.ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, s.ca.Certificate[0]},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
@@ -0,0 +1,763 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-httpproxy/httpproxy"
+)
+
+const (
+	cacheHeader      = "X-Cache"
+	cacheHit         = "HIT"
+	cacheMiss        = "MISS"
+	cacheRevalidated = "REVALIDATED"
+
+	// heuristic freshness for responses with only Last-Modified, RFC 9111
+	// section 4.2.2 suggests 10% of their age
+	cacheHeuristicFraction = 10
+	cacheHeuristicMax      = 24 * time.Hour
+)
+
+// cacheMeta is stored as <key>.json next to the body file <key>.
+type cacheMeta struct {
+	URL      string            `json:"url"`
+	Status   int               `json:"status"`
+	Header   http.Header       `json:"header"`
+	Size     int64             `json:"size"`
+	Stored   time.Time         `json:"stored"`
+	Age      time.Duration     `json:"age"`
+	Lifetime time.Duration     `json:"lifetime"`
+	Vary     map[string]string `json:"vary,omitempty"`
+}
+
+func (m *cacheMeta) currentAge(now time.Time) time.Duration {
+	return m.Age + now.Sub(m.Stored)
+}
+
+func (m *cacheMeta) varyMatches(req *http.Request) bool {
+	for name, value := range m.Vary {
+		if req.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+type cacheObject struct {
+	key  string
+	meta *cacheMeta
+	elem *list.Element
+}
+
+// diskCache is the on-disk HTTP cache of proxy mode, objects are evicted in
+// least recently used order once --cacheMaxSize is exceeded.
+type diskCache struct {
+	mu            sync.Mutex
+	dir           string
+	maxSize       int64
+	maxObjectSize int64
+	size          int64
+	objects       map[string]*cacheObject
+	lru           *list.List
+	// keys being written, a second response for them is not stored
+	filling map[string]bool
+}
+
+// cacheState carries what onRequest found in the cache over to onResponse.
+type cacheState struct {
+	key   string
+	stale *cacheObject
+	store bool
+}
+
+var proxyCache *diskCache
+
+// openCache loads the objects left in --cacheDir by earlier runs, it has to
+// be called before proxy mode starts serving.
+func openCache() error {
+	c := &diskCache{
+		dir:           cacheDir,
+		maxSize:       cacheMaxSize * 1024 * 1024,
+		maxObjectSize: cacheMaxObjectSize * 1024 * 1024,
+		objects:       make(map[string]*cacheObject),
+		lru:           list.New(),
+		filling:       make(map[string]bool),
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return err
+	}
+	type loaded struct {
+		obj      *cacheObject
+		accessed time.Time
+	}
+	var found []loaded
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name := d.Name()
+		if strings.HasPrefix(name, ".tmp-") {
+			// interrupted write
+			os.Remove(path)
+			return nil
+		}
+		key, ok := strings.CutSuffix(name, ".json")
+		if !ok {
+			if _, err := os.Stat(path + ".json"); errors.Is(err, fs.ErrNotExist) {
+				// body of an interrupted commit
+				os.Remove(path)
+			}
+			return nil
+		}
+		meta, fi, err := readCacheObject(path, c.bodyPath(key))
+		if err != nil {
+			logStderr.Printf("WARN: Proxy: dropping cached %s: %v\n", key, err)
+			os.Remove(path)
+			os.Remove(c.bodyPath(key))
+			return nil
+		}
+		found = append(found, loaded{obj: &cacheObject{key: key, meta: meta}, accessed: fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].accessed.After(found[j].accessed) })
+	for _, l := range found {
+		l.obj.elem = c.lru.PushBack(l.obj)
+		c.objects[l.obj.key] = l.obj
+		c.size += l.obj.meta.Size
+	}
+	c.evict()
+	proxyCache = c
+	logStdout.Printf("INFO: Proxy: cache %s holds %d objects, %s\n", c.dir, len(c.objects), englishPrinter.Sprintf("%d bytes", c.size))
+	return nil
+}
+
+func readCacheObject(metaPath, bodyPath string) (*cacheMeta, os.FileInfo, error) {
+	b, err := os.ReadFile(metaPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	meta := &cacheMeta{}
+	if err = json.Unmarshal(b, meta); err != nil {
+		return nil, nil, err
+	}
+	fi, err := os.Stat(bodyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fi.Size() != meta.Size {
+		return nil, nil, fmt.Errorf("body has %d bytes, expected %d", fi.Size(), meta.Size)
+	}
+	return meta, fi, nil
+}
+
+func cacheKey(req *http.Request) string {
+	sum := sha256.Sum256([]byte(req.URL.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *diskCache) bodyPath(key string) string {
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+func (c *diskCache) metaPath(key string) string {
+	return c.bodyPath(key) + ".json"
+}
+
+func (c *diskCache) get(key string) *cacheObject {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	obj := c.objects[key]
+	if obj != nil {
+		c.lru.MoveToFront(obj.elem)
+	}
+	return obj
+}
+
+// begin reserves key for writing, it fails while another write is going on.
+func (c *diskCache) begin(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.filling[key] {
+		return false
+	}
+	c.filling[key] = true
+	return true
+}
+
+func (c *diskCache) end(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.filling, key)
+}
+
+func (c *diskCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if obj := c.objects[key]; obj != nil {
+		c.drop(obj)
+	}
+}
+
+// drop has to be called with c.mu held.
+func (c *diskCache) drop(obj *cacheObject) {
+	c.lru.Remove(obj.elem)
+	delete(c.objects, obj.key)
+	c.size -= obj.meta.Size
+	os.Remove(c.metaPath(obj.key))
+	os.Remove(c.bodyPath(obj.key))
+	proxyCacheSize.Set(float64(c.size))
+}
+
+// evict has to be called with c.mu held, or before the cache is shared.
+func (c *diskCache) evict() {
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		obj := c.lru.Back().Value.(*cacheObject)
+		logStdout.Printf("INFO: Proxy: evicting %s from cache\n", obj.meta.URL)
+		c.drop(obj)
+	}
+	proxyCacheSize.Set(float64(c.size))
+}
+
+// commit makes the body written to tmp and its meta visible, replacing the
+// previous version of the object.
+func (c *diskCache) commit(key string, meta *cacheMeta, tmp string) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(c.bodyPath(key)), 0755); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old := c.objects[key]; old != nil {
+		c.drop(old)
+	}
+	// the meta file is only written for complete bodies, so a crash in
+	// between leaves a body that is ignored on the next start
+	if err = os.Rename(tmp, c.bodyPath(key)); err != nil {
+		return err
+	}
+	if err = writeFileAtomic(c.metaPath(key), b); err != nil {
+		os.Remove(c.bodyPath(key))
+		return err
+	}
+	obj := &cacheObject{key: key, meta: meta}
+	obj.elem = c.lru.PushFront(obj)
+	c.objects[key] = obj
+	c.size += meta.Size
+	c.evict()
+	return nil
+}
+
+// refresh updates obj from the 304 response to a revalidation.
+func (c *diskCache) refresh(obj *cacheObject, resp *http.Response) {
+	meta := *obj.meta
+	meta.Header = obj.meta.Header.Clone()
+	for name, values := range storableHeader(resp.Header) {
+		if name != "Content-Length" {
+			meta.Header[name] = values
+		}
+	}
+	meta.Stored, meta.Age = responseTime(resp)
+	meta.Lifetime = freshnessLifetime(meta.Header)
+	b, err := json.Marshal(&meta)
+	if err == nil {
+		err = writeFileAtomic(c.metaPath(obj.key), b)
+	}
+	if err != nil {
+		logStderr.Println("ERR: Proxy: cache:", err)
+		return
+	}
+	c.mu.Lock()
+	obj.meta = &meta
+	c.mu.Unlock()
+}
+
+func writeFileAtomic(name string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(name), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// cacheControl parses a Cache-Control header into its lower cased
+// directives and their unquoted arguments.
+func cacheControl(h http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(d), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+			}
+		}
+	}
+	return directives
+}
+
+func directiveSeconds(cc map[string]string, name string) (time.Duration, bool) {
+	v, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	secs, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || secs < 0 {
+		return 0, true
+	}
+	return time.Duration(secs) * time.Second, true
+}
+
+// freshnessLifetime follows RFC 9111 section 4.2.1 for a shared cache.
+func freshnessLifetime(h http.Header) time.Duration {
+	cc := cacheControl(h)
+	if _, ok := cc["no-cache"]; ok {
+		return 0
+	}
+	if d, ok := directiveSeconds(cc, "s-maxage"); ok {
+		return d
+	}
+	if d, ok := directiveSeconds(cc, "max-age"); ok {
+		return d
+	}
+	date, err := http.ParseTime(h.Get("Date"))
+	if err != nil {
+		date = time.Now()
+	}
+	if v := h.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			return 0
+		}
+		return max(expires.Sub(date), 0)
+	}
+	if lm, err := http.ParseTime(h.Get("Last-Modified")); err == nil && lm.Before(date) {
+		return min(date.Sub(lm)/cacheHeuristicFraction, cacheHeuristicMax)
+	}
+	return 0
+}
+
+// responseTime returns when resp was received and how old it already was.
+func responseTime(resp *http.Response) (time.Time, time.Duration) {
+	var age time.Duration
+	if secs, err := strconv.ParseInt(resp.Header.Get("Age"), 10, 64); err == nil && secs > 0 {
+		age = time.Duration(secs) * time.Second
+	}
+	return time.Now(), age
+}
+
+// storableHeader drops the hop-by-hop and per-response headers.
+func storableHeader(h http.Header) http.Header {
+	h = h.Clone()
+	for _, name := range []string{"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Connection",
+		"Trailer", "Transfer-Encoding", "Upgrade", "Age", "Via", cacheHeader} {
+		h.Del(name)
+	}
+	return h
+}
+
+// isCacheableRequest tells whether req may be answered from the cache, as a
+// shared cache requests with credentials are never cached.
+func isCacheableRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" {
+		return false
+	}
+	_, noStore := cacheControl(req.Header)["no-store"]
+	return !noStore
+}
+
+// isCacheableResponse tells whether resp, a 200 or 206, may be stored.
+func isCacheableResponse(resp *http.Response) bool {
+	cc := cacheControl(resp.Header)
+	if _, ok := cc["no-store"]; ok {
+		return false
+	}
+	if _, ok := cc["private"]; ok {
+		return false
+	}
+	if resp.Header.Get("Vary") == "*" || len(resp.Header.Values("Set-Cookie")) > 0 {
+		return false
+	}
+	return freshnessLifetime(resp.Header) > 0 || resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != ""
+}
+
+func isFresh(obj *cacheObject, req *http.Request) bool {
+	cc := cacheControl(req.Header)
+	if _, ok := cc["no-cache"]; ok || req.Header.Get("Pragma") == "no-cache" {
+		return false
+	}
+	age := obj.meta.currentAge(time.Now())
+	if d, ok := directiveSeconds(cc, "max-age"); ok && age > d {
+		return false
+	}
+	return age < obj.meta.Lifetime
+}
+
+func hasConditions(req *http.Request) bool {
+	return req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != "" ||
+		req.Header.Get("If-Match") != "" || req.Header.Get("If-Unmodified-Since") != ""
+}
+
+// lookup answers req from the cache when it holds a fresh copy. Stale copies
+// are revalidated by turning req into a conditional request, onResponse
+// finishes the job with the state left in session.
+func (c *diskCache) lookup(req *http.Request, session *proxySession) *http.Response {
+	if !isCacheableRequest(req) {
+		return nil
+	}
+	state := &cacheState{key: cacheKey(req), store: req.Method == http.MethodGet && req.Header.Get("Range") == ""}
+	session.cache = state
+	obj := c.get(state.key)
+	if obj == nil || !obj.meta.varyMatches(req) {
+		return nil
+	}
+	if isFresh(obj, req) {
+		if resp := c.response(req, obj, cacheHit); resp != nil {
+			proxyCacheRequests.WithLabelValues(cacheHit).Inc()
+			return resp
+		}
+		return nil
+	}
+	etag, lastModified := obj.meta.Header.Get("ETag"), obj.meta.Header.Get("Last-Modified")
+	if !hasConditions(req) && (etag != "" || lastModified != "") {
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lastModified != "" {
+			req.Header.Set("If-Modified-Since", lastModified)
+		}
+		state.stale = obj
+	}
+	return nil
+}
+
+// update stores or refreshes the cache with resp as received from upstream
+// and marks it with the cache header.
+func (c *diskCache) update(prx *httpproxy.Proxy, req *http.Request, resp *http.Response, state *cacheState) {
+	switch {
+	case resp.StatusCode == http.StatusNotModified && state.stale != nil:
+		c.refresh(state.stale, resp)
+		req.Header.Del("If-None-Match")
+		req.Header.Del("If-Modified-Since")
+		resp.Body.Close()
+		if cached := c.response(req, state.stale, cacheRevalidated); cached != nil {
+			*resp = *cached
+			proxyCacheRequests.WithLabelValues(cacheRevalidated).Inc()
+			return
+		}
+		// the cached body is gone, the 304 answers conditions the client
+		// never sent, ask again for the object itself
+		fetched, err := prx.Rt.RoundTrip(req.Clone(req.Context()))
+		if err != nil {
+			logStderr.Println("ERR: Proxy: cache:", err)
+			*resp = *httpproxy.InMemoryResponse(http.StatusBadGateway, nil, nil)
+		} else {
+			*resp = *fetched
+			if resp.StatusCode == http.StatusOK && state.store && isCacheableResponse(resp) {
+				c.store(req, resp, state.key)
+			}
+		}
+	case resp.StatusCode == http.StatusOK && state.store && isCacheableResponse(resp):
+		c.store(req, resp, state.key)
+	case resp.StatusCode == http.StatusPartialContent && isCacheableResponse(resp):
+		// ranged downloads are cached by fetching the whole file once
+		if size := contentRangeSize(resp.Header.Get("Content-Range")); size > 0 && size <= c.maxObjectSize {
+			c.fill(prx, req, state.key)
+		}
+	}
+	proxyCacheRequests.WithLabelValues(cacheMiss).Inc()
+	resp.Header.Set(cacheHeader, cacheMiss)
+}
+
+func contentRangeSize(contentRange string) int64 {
+	_, total, ok := strings.Cut(contentRange, "/")
+	if !ok {
+		return -1
+	}
+	size, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+// store tees the body of resp into the cache while the client receives it.
+func (c *diskCache) store(req *http.Request, resp *http.Response, key string) {
+	if resp.ContentLength > c.maxObjectSize || !c.begin(key) {
+		return
+	}
+	c.tee(req, resp, key)
+}
+
+// tee has to be called with key reserved by begin.
+func (c *diskCache) tee(req *http.Request, resp *http.Response, key string) {
+	tmp, err := os.CreateTemp(c.dir, ".tmp-")
+	if err != nil {
+		logStderr.Println("ERR: Proxy: cache:", err)
+		c.end(key)
+		return
+	}
+	stored, age := responseTime(resp)
+	meta := &cacheMeta{
+		URL:      req.URL.String(),
+		Status:   resp.StatusCode,
+		Header:   storableHeader(resp.Header),
+		Stored:   stored,
+		Age:      age,
+		Lifetime: freshnessLifetime(resp.Header),
+	}
+	for _, v := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" {
+				if meta.Vary == nil {
+					meta.Vary = make(map[string]string)
+				}
+				meta.Vary[name] = req.Header.Get(name)
+			}
+		}
+	}
+	resp.Body = &cacheWriter{ReadCloser: resp.Body, cache: c, key: key, meta: meta, file: tmp, expected: resp.ContentLength}
+}
+
+// fill downloads the whole object behind the ranged request req in the
+// background, so the following ranges are served from the cache.
+func (c *diskCache) fill(prx *httpproxy.Proxy, req *http.Request, key string) {
+	if c.get(key) != nil || !c.begin(key) {
+		return
+	}
+	r, err := http.NewRequestWithContext(context.Background(), http.MethodGet, req.URL.String(), nil)
+	if err != nil {
+		c.end(key)
+		return
+	}
+	for name, values := range req.Header {
+		switch name {
+		case "Range", "If-Range", "If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since":
+		default:
+			r.Header[name] = values
+		}
+	}
+	go func() {
+		resp, err := prx.Rt.RoundTrip(r)
+		if err != nil {
+			logStderr.Println("ERR: Proxy: cache fill:", err)
+			c.end(key)
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.ContentLength > c.maxObjectSize || !isCacheableResponse(resp) {
+			c.end(key)
+			return
+		}
+		logStdout.Printf("INFO: Proxy: caching %s\n", r.URL)
+		c.tee(r, resp, key)
+		io.Copy(io.Discard, resp.Body)
+	}()
+}
+
+// cacheWriter writes what the client reads to a temporary file, which is
+// committed to the cache when the body was complete.
+type cacheWriter struct {
+	io.ReadCloser
+	cache    *diskCache
+	key      string
+	meta     *cacheMeta
+	file     *os.File
+	expected int64
+	written  int64
+	failed   bool
+	once     sync.Once
+}
+
+func (w *cacheWriter) Read(p []byte) (int, error) {
+	n, err := w.ReadCloser.Read(p)
+	if n > 0 && !w.failed {
+		if _, werr := w.file.Write(p[:n]); werr != nil {
+			logStderr.Println("ERR: Proxy: cache:", werr)
+			w.failed = true
+		}
+		w.written += int64(n)
+		w.failed = w.failed || w.written > w.cache.maxObjectSize
+	}
+	if err == io.EOF {
+		w.finish(true)
+	}
+	return n, err
+}
+
+func (w *cacheWriter) Close() error {
+	err := w.ReadCloser.Close()
+	w.finish(false)
+	return err
+}
+
+func (w *cacheWriter) finish(eof bool) {
+	w.once.Do(func() {
+		defer w.cache.end(w.key)
+		err := w.file.Close()
+		complete := eof && !w.failed && (w.expected < 0 || w.written == w.expected)
+		if err == nil && complete {
+			w.meta.Size = w.written
+			w.meta.Header.Set("Content-Length", strconv.FormatInt(w.written, 10))
+			err = w.cache.commit(w.key, w.meta, w.file.Name())
+		}
+		if err != nil {
+			logStderr.Println("ERR: Proxy: cache:", err)
+		}
+		if err != nil || !complete {
+			os.Remove(w.file.Name())
+		}
+	})
+}
+
+// response builds the answer to req from obj, honoring the conditional and
+// range headers of req. It returns nil if the cached body is gone.
+func (c *diskCache) response(req *http.Request, obj *cacheObject, result string) *http.Response {
+	c.mu.Lock()
+	meta := obj.meta
+	c.mu.Unlock()
+	now := time.Now()
+	header := meta.Header.Clone()
+	header.Set("Age", strconv.FormatInt(int64(meta.currentAge(now)/time.Second), 10))
+	header.Set(cacheHeader, result)
+
+	if notModified(req, meta) {
+		header.Del("Content-Length")
+		resp := httpproxy.InMemoryResponse(http.StatusNotModified, header, nil)
+		return resp
+	}
+
+	f, err := os.Open(c.bodyPath(obj.key))
+	if err != nil {
+		logStderr.Println("ERR: Proxy: cache:", err)
+		c.remove(obj.key)
+		return nil
+	}
+	os.Chtimes(c.metaPath(obj.key), now, now)
+
+	status, offset, length := meta.Status, int64(0), meta.Size
+	if start, n, ok := cachedRange(req, meta); ok {
+		if n < 0 {
+			f.Close()
+			header.Del("Content-Length")
+			header.Set("Content-Range", "bytes */"+strconv.FormatInt(meta.Size, 10))
+			return httpproxy.InMemoryResponse(http.StatusRequestedRangeNotSatisfiable, header, nil)
+		}
+		status, offset, length = http.StatusPartialContent, start, n
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+n-1, meta.Size))
+	}
+	header.Set("Content-Length", strconv.FormatInt(length, 10))
+	resp := httpproxy.InMemoryResponse(status, header, nil)
+	resp.ContentLength = length
+	if req.Method == http.MethodHead {
+		f.Close()
+		return resp
+	}
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}
+	return resp
+}
+
+func notModified(req *http.Request, meta *cacheMeta) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(meta.Header.Get("ETag"), "W/")
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || (etag != "" && tag == etag) {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(meta.Header.Get("Last-Modified"))
+	return err == nil && !lm.After(ims)
+}
+
+// cachedRange returns the single byte range req asks for, n is -1 when the
+// range cannot be satisfied. Multiple ranges and failed If-Range conditions
+// are answered with the whole body.
+func cachedRange(req *http.Request, meta *cacheMeta) (start, n int64, ok bool) {
+	spec, found := strings.CutPrefix(req.Header.Get("Range"), "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	if ifRange := req.Header.Get("If-Range"); ifRange != "" &&
+		ifRange != meta.Header.Get("ETag") && ifRange != meta.Header.Get("Last-Modified") {
+		return 0, 0, false
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false
+	}
+	size := meta.Size
+	if first == "" {
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+		if suffix <= 0 || size == 0 {
+			return 0, -1, true
+		}
+		suffix = min(suffix, size)
+		return size - suffix, suffix, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	if start >= size {
+		return 0, -1, true
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, false
+		}
+		end = min(end, size-1)
+	}
+	return start, end - start + 1, true
+}
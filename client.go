@@ -31,6 +31,7 @@ func getHTTPClient(isHTTP3 bool) *http.Client {
 	}
 	return &http.Client{
 		Transport: &http.Transport{
+			Proxy: upstreamProxy,
 			TLSClientConfig: &tls.Config{
 				InsecureSkipVerify: insecureSkipVerify,
 			},
@@ -53,6 +54,15 @@ func getHTTPClient(isHTTP3 bool) *http.Client {
 	}
 }
 
+// bytesPerSecond never divides by zero, transfers on a LAN can finish within
+// a millisecond.
+func bytesPerSecond(n int64, d time.Duration) int64 {
+	if d < time.Millisecond {
+		d = time.Millisecond
+	}
+	return n * 1000 / int64(d/time.Millisecond)
+}
+
 func getContentLength(headers http.Header) (int64, error) {
 	// Try to get content length from Content-Range header first
 	contentRange := headers.Get("Content-Range")
@@ -156,5 +166,9 @@ func SetRequestHeader(req *http.Request) {
 	if referrer != "" {
 		req.Header.Set("Referer", referrer)
 	}
+	if basicAuth != "" {
+		user, pass, _ := strings.Cut(basicAuth, ":")
+		req.SetBasicAuth(user, pass)
+	}
 
 }
@@ -1,28 +1,71 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
+	"strings"
 
 	"github.com/quic-go/quic-go/http3"
 	"github.com/missdeer/transfer/keypair"
 	flag "github.com/spf13/pflag"
+	"golang.org/x/net/http2"
 )
 
 var (
 	listenAddr string
 	certFile   string
 	keyFile    string
+	upstream   string
 )
 
 func printExamples() {
 	fmt.Println("Examples:")
 	fmt.Println("\tquicplugin")
 	fmt.Println("\tquicplugin -k example.com.key -t fullchain.cer")
+	fmt.Println("\tquicplugin --upstream h2c://127.0.0.1:50051")
+}
+
+// createReverseProxy relays to upstream, h2c:// upstreams get HTTP/2 without
+// TLS so that gRPC trailers make it through. The upstream learns about the
+// client and the https:// it came with from X-Forwarded-For/Proto/Host and
+// Forwarded, those sent by the client are dropped.
+func createReverseProxy(upstream string) (*httputil.ReverseProxy, error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+	h2c := u.Scheme == "h2c"
+	if h2c {
+		u.Scheme = "http"
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(u)
+			pr.Out.Host = pr.In.Host
+			pr.SetXForwarded()
+			node := pr.Out.Header.Get("X-Forwarded-For")
+			if strings.Contains(node, ":") {
+				node = `"[` + node + `]"`
+			}
+			pr.Out.Header.Set("Forwarded", fmt.Sprintf("for=%s;host=%q;proto=https", node, pr.In.Host))
+		},
+	}
+	if h2c {
+		proxy.Transport = &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		}
+	}
+	return proxy, nil
 }
 
 func listenAndServe(certFile, keyFile string, handler http.Handler) error {
@@ -65,6 +108,7 @@ func listenAndServe(certFile, keyFile string, handler http.Handler) error {
 	httpServer.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		handler.ServeHTTP(w, r)
 	})
+	quicServer.Handler = handler
 
 	hErr := make(chan error)
 	qErr := make(chan error)
@@ -87,6 +131,7 @@ func main() {
 	flag.StringVarP(&listenAddr, "listen", "l", "0.0.0.0:443", "listen address, server/proxy mode only")
 	flag.StringVarP(&certFile, "cert", "t", "cert.pem", "SSL certificate file path")
 	flag.StringVarP(&keyFile, "key", "k", "key.pem", "SSL key file path")
+	flag.StringVarP(&upstream, "upstream", "u", "http://127.0.0.1", "relay the requests to this address, h2c://host:port talks HTTP/2 without TLS to it")
 	flag.BoolVarP(&help, "help", "h", false, "show this help message")
 	flag.Parse()
 
@@ -97,15 +142,12 @@ func main() {
 		return
 	}
 
+	proxy, err := createReverseProxy(upstream)
+	if err != nil {
+		log.Fatal(err)
+	}
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		u := *r.URL
-		u.Host = "127.0.0.1"
-		u.Scheme = "http"
-		u.Path = "/"
-		proxy := httputil.NewSingleHostReverseProxy(&u)
-		proxy.ServeHTTP(w, r)
-	})
+	mux.Handle("/", proxy)
 
 	log.Fatal(listenAndServe(certFile, keyFile, mux))
 }
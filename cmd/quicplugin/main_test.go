@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// testUpstream answers like a gRPC service on /grpc, streams server-sent
+// events on /sse and echoes WebSocket frames on /ws, over h2c and HTTP/1.1.
+func testUpstream(t *testing.T, release chan struct{}) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/grpc", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("X-Upstream-Proto", r.Proto)
+		w.Write(body)
+		w.Header().Set("Grpc-Status", "0")
+	})
+	mux.HandleFunc("/sse", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+		fmt.Fprint(w, "data: second\n\n")
+	})
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	})
+	srv := httptest.NewServer(h2c.NewHandler(mux, &http2.Server{}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// startPlugin serves createReverseProxy for upstream over HTTP/3, like
+// quicplugin does, and returns its URL and a client for it.
+func startPlugin(t *testing.T, upstream string) (string, *http.Client) {
+	t.Helper()
+	proxy, err := createReverseProxy(upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// borrow the test certificate of httptest
+	certSrv := httptest.NewTLSServer(http.NotFoundHandler())
+	certs := certSrv.TLS.Certificates
+	certSrv.Close()
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &http3.Server{Handler: proxy, TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: certs})}
+	go s.Serve(udpConn)
+	rt := &http3.RoundTripper{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	t.Cleanup(func() {
+		rt.Close()
+		s.Close()
+		udpConn.Close()
+	})
+	return "https://" + udpConn.LocalAddr().String(), &http.Client{Transport: rt, Timeout: 10 * time.Second}
+}
+
+func TestGRPCTrailers(t *testing.T) {
+	upstream := testUpstream(t, nil)
+	base, client := startPlugin(t, "h2c://"+upstream.Listener.Addr().String())
+	req, _ := http.NewRequest(http.MethodPost, base+"/grpc", strings.NewReader("hello"))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello" {
+		t.Errorf("body = %q, want %q", body, "hello")
+	}
+	if got := resp.Header.Get("X-Upstream-Proto"); got != "HTTP/2.0" {
+		t.Errorf("upstream was reached with %s, want HTTP/2.0", got)
+	}
+	if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+		t.Errorf("Grpc-Status trailer = %q, want 0", got)
+	}
+}
+
+func TestServerSentEvents(t *testing.T) {
+	release := make(chan struct{})
+	upstream := testUpstream(t, release)
+	base, client := startPlugin(t, upstream.URL)
+	resp, err := client.Get(base + "/sse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	br := bufio.NewReader(resp.Body)
+	first := make(chan string, 1)
+	go func() {
+		line, _ := br.ReadString('\n')
+		first <- line
+	}()
+	select {
+	case line := <-first:
+		if line != "data: first\n" {
+			t.Fatalf("first event = %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the first event was not flushed")
+	}
+	close(release)
+	rest, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "\ndata: second\n\n" {
+		t.Errorf("rest of the stream = %q", rest)
+	}
+}
+
+// TestWebSocket serves the proxy over HTTP/1.1, HTTP/3 has no Upgrade.
+func TestWebSocket(t *testing.T) {
+	upstream := testUpstream(t, nil)
+	proxy, err := createReverseProxy(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewTLSServer(proxy)
+	defer front.Close()
+	conn, err := tls.Dial("tcp", front.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprint(conn, "GET /ws HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %s, want 101", resp.Status)
+	}
+	fmt.Fprint(conn, "ping")
+	echo := make([]byte, 4)
+	if _, err = io.ReadFull(br, echo); err != nil {
+		t.Fatal(err)
+	}
+	if string(echo) != "ping" {
+		t.Errorf("echo = %q, want ping", echo)
+	}
+}
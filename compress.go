@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// responseEncodings are the codings server and relay mode compress with, the
+// preferred first when the client accepts several equally.
+var responseEncodings = []string{"zstd", "br", "gzip"}
+
+// precompressedExts are the siblings server mode serves instead of a file,
+// file.br is preferred to file.gz.
+var precompressedExts = map[string]string{"br": ".br", "gzip": ".gz"}
+
+// encoder is what the gzip, brotli and zstd writers have in common.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+var encoderPools = map[string]*sync.Pool{
+	"gzip": {New: func() any {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	}},
+	"br": {New: func() any {
+		return brotli.NewWriterLevel(nil, 4)
+	}},
+	"zstd": {New: func() any {
+		// browsers decode windows up to 8 MiB
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(8<<20))
+		return w
+	}},
+}
+
+// negotiateEncoding picks the coding of offered with the highest q-value in
+// an Accept-Encoding header, empty when the client accepts none of them.
+func negotiateEncoding(acceptEncoding string, offered []string) string {
+	qs := make(map[string]float64)
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if name != "" {
+			qs[strings.ToLower(name)] = q
+		}
+	}
+	best, bestQ := "", 0.0
+	for _, enc := range offered {
+		q, ok := qs[enc]
+		if !ok {
+			q = qs["*"]
+		}
+		if q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
+
+// isCompressible matches a Content-Type against --compressTypes.
+func isCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range compressTypes {
+		if ok, _ := path.Match(strings.ToLower(strings.TrimSpace(pattern)), mediaType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// withCompression compresses the responses of h with the coding the client
+// prefers when --compress is given. Responses which are small, of a type
+// not in --compressTypes, already encoded or partial are left alone, so
+// byte ranges always refer to the uncompressed content. HEAD gets the
+// headers GET would.
+func withCompression(h http.Handler) http.Handler {
+	if !compressResponses {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), responseEncodings)
+		if encoding == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressResponseWriter{ResponseWriter: w, encoding: encoding, head: r.Method == http.MethodHead}
+		defer cw.close()
+		h.ServeHTTP(cw, r)
+	})
+}
+
+// compressResponseWriter decides on the first WriteHeader or Write whether
+// the response gets compressed.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding string
+	// head only decides on the headers, there is no body to compress
+	head    bool
+	decided bool
+	enc     encoder
+}
+
+func (w *compressResponseWriter) WriteHeader(status int) {
+	if w.decided || (status >= 100 && status < 200 && status != http.StatusSwitchingProtocols) {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.decided = true
+	h := w.Header()
+	if status == http.StatusOK && h.Get("Content-Encoding") == "" && isCompressible(h.Get("Content-Type")) {
+		size, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+		if err != nil || size >= compressMinSize {
+			if !w.head {
+				w.enc = encoderPools[w.encoding].Get().(encoder)
+				w.enc.Reset(w.ResponseWriter)
+			}
+			h.Set("Content-Encoding", w.encoding)
+			h.Del("Content-Length")
+			// the ranges of the compressed content are not those of
+			// the file, and neither are its validators
+			h.Del("Accept-Ranges")
+			if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				h.Set("ETag", "W/"+etag)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *compressResponseWriter) Write(p []byte) (int, error) {
+	if !w.decided {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.enc != nil {
+		return w.enc.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush sends what was compressed so far, server-sent events keep arriving
+// one by one.
+func (w *compressResponseWriter) Flush() {
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *compressResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *compressResponseWriter) close() {
+	if w.enc == nil {
+		return
+	}
+	w.enc.Close()
+	w.enc.Reset(nil)
+	encoderPools[w.encoding].Put(w.enc)
+	w.enc = nil
+}
+
+// servePrecompressed answers a GET for a file with its file.br or file.gz
+// sibling when the client accepts that coding. Range requests get the file
+// itself, like with withCompression.
+func servePrecompressed(w http.ResponseWriter, r *http.Request, fsys http.FileSystem) bool {
+	if !compressResponses || (r.Method != http.MethodGet && r.Method != http.MethodHead) || r.Header.Get("Range") != "" {
+		return false
+	}
+	name := path.Clean("/" + r.URL.Path)
+	f, err := fsys.Open(name)
+	if err != nil {
+		return false
+	}
+	fi, err := f.Stat()
+	f.Close()
+	if err != nil || fi.IsDir() {
+		return false
+	}
+	// fall back to the next accepted coding when a sibling is missing
+	offered := []string{"br", "gzip"}
+	var (
+		encoding string
+		sibling  http.File
+		sfi      fs.FileInfo
+	)
+	for sibling == nil {
+		if encoding = negotiateEncoding(r.Header.Get("Accept-Encoding"), offered); encoding == "" {
+			return false
+		}
+		offered = slices.DeleteFunc(offered, func(enc string) bool { return enc == encoding })
+		if sibling, err = fsys.Open(name + precompressedExts[encoding]); err != nil {
+			continue
+		}
+		if sfi, err = sibling.Stat(); err != nil || sfi.IsDir() {
+			sibling.Close()
+			sibling = nil
+		}
+	}
+	defer sibling.Close()
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Encoding", encoding)
+	http.ServeContent(noRangesWriter{w}, r, name, sfi.ModTime(), sibling)
+	return true
+}
+
+// noRangesWriter takes back the Accept-Ranges of http.ServeContent, the byte
+// ranges of a precompressed sibling are not those of the file.
+type noRangesWriter struct {
+	http.ResponseWriter
+}
+
+func (w noRangesWriter) WriteHeader(status int) {
+	w.Header().Del("Accept-Ranges")
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// uploadEncodings are the codings server mode decodes uploads from, the
+// preferred first.
+var uploadEncodings = []string{"zstd", "gzip"}
+
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// decodeBody undoes the Content-Encoding of a download or an upload.
+func decodeBody(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return io.NopCloser(r), nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "br":
+		return io.NopCloser(brotli.NewReader(r)), nil
+	case "zstd":
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(64<<20))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("%w %s", errUnsupportedEncoding, encoding)
+}
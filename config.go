@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// listener is a server, proxy, socks5 or relay endpoint run by the process.
+// Without --config there is a single one made of --mode, --listen,
+// --protocol, --cert, --key and the relay port mappings.
+type listener struct {
+	Mode     string
+	Listen   string
+	Protocol string
+	Cert     string
+	Key      string
+	// relay port mappings like 8080<->http://172.16.0.1:8080
+	Mappings []string
+	// --relayRoutes file of a relay listener
+	Routes string
+}
+
+var (
+	listeners []*listener
+	// commandLineFlags are the flags given on the command line, they win
+	// over the settings of --config
+	commandLineFlags map[string]bool
+)
+
+// runsMode tells whether one of the listeners is in the given work mode.
+func runsMode(mode string) bool {
+	for _, l := range listeners {
+		if l.Mode == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// loadConfig reads the --config file, for example:
+//
+//	settings:
+//	  htpasswd: /etc/transfer/htpasswd
+//	  accessLog: /var/log/transfer/access.log
+//	  allowIP: [10.0.0.0/8, 192.168.0.0/16]
+//	  relayMaxConns: 100
+//	listeners:
+//	  - mode: server
+//	    listen: :443
+//	    protocol: https
+//	    cert: /etc/transfer/cert.pem
+//	    key: /etc/transfer/key.pem
+//	  - mode: proxy
+//	    listen: :3128
+//	  - mode: relay
+//	    mappings: ["8080<->http://172.16.0.1:8080", "2222<->tcp://172.16.0.5:22"]
+//	  - mode: relay
+//	    protocol: https
+//	    routes: /etc/transfer/routes.yaml
+//
+// settings takes the long name of any flag, flags given on the command line
+// win over it. listeners replace --mode, --listen, --protocol, --cert, --key
+// and the relay port mappings of the command line, which lets one process
+// serve several modes at once. Everything else, authentication like user,
+// htpasswd and allowIP and limits like relayMaxConns included, is a setting
+// shared by all listeners and is refused under listeners. Errors name the
+// line they are about.
+//
+// The file is read again on SIGHUP or when it changes, see reloadConfig.
+func loadConfig(path string) error {
+	cfg, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+	commandLineFlags = make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		commandLineFlags[f.Name] = true
+	})
+	for _, setting := range cfg.settings {
+		if commandLineFlags[setting.name] {
+			continue
+		}
+		for _, v := range setting.values {
+			if err = flag.Set(setting.name, v); err != nil {
+				return configError(path, setting.node, "%v", err)
+			}
+		}
+	}
+	listeners = cfg.listeners
+	// settings may come after the listeners
+	for _, l := range listeners {
+		l.Cert = ternaryOp(l.Cert != "", l.Cert, certFile)
+		l.Key = ternaryOp(l.Key != "", l.Key, keyFile)
+	}
+	return nil
+}
+
+// configSetting is an entry of the settings section.
+type configSetting struct {
+	name   string
+	values []string
+	node   *yaml.Node
+}
+
+type config struct {
+	settings  []configSetting
+	listeners []*listener
+}
+
+func readConfig(path string) (*config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var root yaml.Node
+	if err = yaml.Unmarshal(b, &root); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(root.Content) == 0 {
+		// also what a reload may see while the file is being written
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	cfg := &config{}
+	doc := root.Content[0]
+	if doc.Kind != yaml.MappingNode {
+		return nil, configError(path, doc, "expected settings and listeners")
+	}
+	for i := 0; i < len(doc.Content); i += 2 {
+		key, value := doc.Content[i], doc.Content[i+1]
+		switch key.Value {
+		case "settings":
+			cfg.settings, err = readSettings(path, value)
+		case "listeners":
+			cfg.listeners, err = readListeners(path, value)
+		default:
+			err = configError(path, key, "unknown section %s, expected settings or listeners", key.Value)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+func configError(path string, n *yaml.Node, format string, a ...any) error {
+	return fmt.Errorf("%s:%d: %s", path, n.Line, fmt.Sprintf(format, a...))
+}
+
+// readSettings checks that the settings section only names flags, which are
+// then set through pflag so that they are parsed like on the command line.
+func readSettings(path string, n *yaml.Node) ([]configSetting, error) {
+	if n.Kind != yaml.MappingNode {
+		return nil, configError(path, n, "settings must map flag names to values")
+	}
+	var settings []configSetting
+	for i := 0; i < len(n.Content); i += 2 {
+		key, value := n.Content[i], n.Content[i+1]
+		f := flag.Lookup(key.Value)
+		if f == nil || key.Value == "config" || key.Value == "help" {
+			return nil, configError(path, key, "unknown setting %s", key.Value)
+		}
+		values, err := configScalars(path, value)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) > 1 && !strings.HasSuffix(f.Value.Type(), "Slice") && !strings.HasSuffix(f.Value.Type(), "Array") {
+			return nil, configError(path, value, "%s takes a single value", key.Value)
+		}
+		settings = append(settings, configSetting{name: key.Value, values: values, node: value})
+	}
+	return settings, nil
+}
+
+// configScalars returns the value of a scalar node, or the values of a list
+// of scalars.
+func configScalars(path string, n *yaml.Node) ([]string, error) {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		return []string{n.Value}, nil
+	case yaml.SequenceNode:
+		values := make([]string, 0, len(n.Content))
+		for _, item := range n.Content {
+			if item.Kind != yaml.ScalarNode {
+				return nil, configError(path, item, "expected a plain value")
+			}
+			values = append(values, item.Value)
+		}
+		return values, nil
+	}
+	return nil, configError(path, n, "expected a value or a list of values")
+}
+
+func readListeners(path string, n *yaml.Node) ([]*listener, error) {
+	if n.Kind != yaml.SequenceNode {
+		return nil, configError(path, n, "listeners must be a list")
+	}
+	var result []*listener
+	addrs := make(map[string]int)
+	for _, item := range n.Content {
+		l, err := readListener(path, item)
+		if err != nil {
+			return nil, err
+		}
+		if l.Listen != "" {
+			if line, ok := addrs[l.Listen]; ok {
+				return nil, configError(path, item, "%s is already used by the listener at line %d", l.Listen, line)
+			}
+			addrs[l.Listen] = item.Line
+		}
+		result = append(result, l)
+	}
+	return result, nil
+}
+
+// isListenerField tells the listener fields which are also flags.
+func isListenerField(name string) bool {
+	switch name {
+	case "mode", "listen", "protocol", "cert", "key":
+		return true
+	}
+	return false
+}
+
+func readListener(path string, n *yaml.Node) (*listener, error) {
+	if n.Kind != yaml.MappingNode {
+		return nil, configError(path, n, "a listener must be a mapping")
+	}
+	l := &listener{Protocol: "http"}
+	for i := 0; i < len(n.Content); i += 2 {
+		key, value := n.Content[i], n.Content[i+1]
+		if key.Value == "auth" || key.Value == "limits" || (flag.Lookup(key.Value) != nil && !isListenerField(key.Value)) {
+			return nil, configError(path, key, "%s applies to all listeners, set it under settings", key.Value)
+		}
+		values, err := configScalars(path, value)
+		if err != nil {
+			return nil, err
+		}
+		if key.Value == "mappings" {
+			l.Mappings = values
+			continue
+		}
+		if len(values) != 1 {
+			return nil, configError(path, value, "%s takes a single value", key.Value)
+		}
+		switch key.Value {
+		case "mode":
+			l.Mode = values[0]
+		case "listen":
+			l.Listen = values[0]
+		case "protocol":
+			l.Protocol = strings.ToLower(values[0])
+		case "cert":
+			l.Cert = values[0]
+		case "key":
+			l.Key = values[0]
+		case "routes":
+			l.Routes = values[0]
+		default:
+			return nil, configError(path, key, "unknown listener field %s, expected mode, listen, protocol, cert, key, mappings or routes", key.Value)
+		}
+	}
+
+	switch l.Protocol {
+	case "http", "https", "quic":
+	default:
+		return nil, configError(path, n, "unsupported protocol %s, candidates: http, https, quic", l.Protocol)
+	}
+	switch l.Mode {
+	case "server", "proxy", "socks5":
+		if l.Listen == "" {
+			return nil, configError(path, n, "%s listener needs listen", l.Mode)
+		}
+		if len(l.Mappings) > 0 || l.Routes != "" {
+			return nil, configError(path, n, "only relay listeners take mappings and routes")
+		}
+		if l.Mode == "socks5" && l.Protocol != "http" {
+			return nil, configError(path, n, "socks5 listener cannot use protocol %s", l.Protocol)
+		}
+	case "relay":
+		if len(l.Mappings) == 0 && l.Routes == "" {
+			return nil, configError(path, n, "relay listener needs mappings or routes")
+		}
+		if l.Listen != "" {
+			return nil, configError(path, n, "relay listener takes its ports from mappings and routes, not listen")
+		}
+	case "":
+		return nil, configError(path, n, "listener needs a mode")
+	default:
+		return nil, configError(path, n, "unsupported listener mode %s, candidates: server, proxy, socks5, relay", l.Mode)
+	}
+	return l, nil
+}
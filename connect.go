@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/go-httpproxy/httpproxy"
+)
+
+const (
+	connectTunnel = "tunnel"
+	connectMitm   = "mitm"
+	connectBlock  = "block"
+)
+
+// connectRule decides what proxy mode does with the CONNECT requests for the
+// hosts matching pattern, the first matching rule wins.
+type connectRule struct {
+	pattern hostPattern
+	action  string
+}
+
+type proxySessionKey struct{}
+
+var (
+	connectRules []connectRule
+)
+
+func isConnectAction(action string) bool {
+	switch action {
+	case connectTunnel, connectMitm, connectBlock:
+		return true
+	}
+	return false
+}
+
+// loadConnectRules parses --connectRule and --connectDefault, the CA is only
+// loaded when something is going to be intercepted.
+func loadConnectRules() error {
+	if !isConnectAction(connectDefault) {
+		return fmt.Errorf("unsupported connect action %s, candidates: tunnel, mitm, block", connectDefault)
+	}
+	needCA := connectDefault == connectMitm
+	for _, s := range connectRuleSpecs {
+		pattern, action, ok := strings.Cut(s, "=")
+		if !ok || !isConnectAction(action) {
+			return fmt.Errorf("invalid connect rule %s, expected <host pattern>=<tunnel|mitm|block>", s)
+		}
+		p, err := parseHostPattern(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid connect rule %s: %w", s, err)
+		}
+		connectRules = append(connectRules, connectRule{pattern: p, action: action})
+		needCA = needCA || action == connectMitm
+	}
+	if needCA && runsMode("proxy") {
+		return loadCA()
+	}
+	return nil
+}
+
+func connectActionFor(host string) string {
+	for _, rule := range connectRules {
+		if rule.pattern.match(host) {
+			return rule.action
+		}
+	}
+	return connectDefault
+}
+
+// serveMitm terminates the TLS connection requested by the CONNECT request r
+// with a certificate minted for the target host and feeds the decrypted
+// requests back into prx, so they pass the same hooks as plain HTTP ones.
+func serveMitm(prx *httpproxy.Proxy, w http.ResponseWriter, r *http.Request, session *proxySession) {
+	host := r.URL.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "443")
+	}
+	hij, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection cannot be intercepted", http.StatusInternalServerError)
+		return
+	}
+	conn, _, err := hij.Hijack()
+	if err != nil {
+		logStderr.Println("ERR: Proxy:", err)
+		return
+	}
+	if _, err = conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n")); err != nil {
+		conn.Close()
+		return
+	}
+
+	tlsConn := tls.Server(conn, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = stripPort(host)
+			}
+			return mitmSigner.certificate(name)
+		},
+		// httpproxy only speaks HTTP/1
+		NextProtos: []string{"http/1.1"},
+	})
+	logged := withAccessLog(prx)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL.Scheme = "https"
+		req.URL.Host = host
+		req.RequestURI = req.URL.String()
+		req = req.WithContext(context.WithValue(req.Context(), proxySessionKey{}, session))
+		logged.ServeHTTP(w, req)
+	})
+
+	ln := &oneConnListener{conn: tlsConn, done: make(chan struct{})}
+	s := &http.Server{
+		Handler:  handler,
+		ErrorLog: logStderr,
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				ln.Close()
+			}
+		},
+	}
+	s.Serve(ln)
+}
+
+// serveTunnel connects the client of the CONNECT request r with the target
+// host, through the upstream proxy where configured.
+func serveTunnel(w http.ResponseWriter, r *http.Request) {
+	host := r.URL.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "443")
+	}
+	remote, err := dialUpstream(r.Context(), host)
+	if err != nil {
+		logStderr.Println("ERR: Proxy: Connect:", err)
+		proxyUpstreamErrors.WithLabelValues("Connect").Inc()
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer remote.Close()
+	hij, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection cannot be tunneled", http.StatusInternalServerError)
+		return
+	}
+	conn, _, err := hij.Hijack()
+	if err != nil {
+		logStderr.Println("ERR: Proxy:", err)
+		return
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n")); err != nil {
+		return
+	}
+	splice(conn, remote)
+}
+
+// splice copies between client and remote in both directions until both
+// sides are done, and returns how much went either way. Once remote is done
+// the client connection is shut down, which also ends the other direction.
+func splice(client, remote net.Conn) (sent, received int64) {
+	type closeWriter interface {
+		CloseWrite() error
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		received, _ = io.Copy(remote, client)
+		if c, ok := remote.(closeWriter); ok {
+			c.CloseWrite()
+		}
+	}()
+	sent, _ = io.Copy(client, remote)
+	if c, ok := client.(closeWriter); ok {
+		c.CloseWrite()
+	} else {
+		client.Close()
+	}
+	<-done
+	return sent, received
+}
+
+// oneConnListener hands a single connection to http.Server and blocks until
+// that connection is done.
+type oneConnListener struct {
+	conn net.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	if c := l.conn; c != nil {
+		l.conn = nil
+		return c, nil
+	}
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *oneConnListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *oneConnListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
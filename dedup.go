@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	contentHashHeader = "X-Content-Sha256"
+)
+
+var (
+	regSHA256Hex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+	errContentHashMismatch = errors.New("content hash mismatch")
+)
+
+func blobStorePath() string {
+	return path.Clean("/" + filepath.ToSlash(blobDir))
+}
+
+// blobPath returns where the content with the given SHA-256 hex digest is
+// kept, fanned out by the first byte to keep directories small.
+func blobPath(hash string) string {
+	return path.Join(blobStorePath(), "sha256", hash[:2], hash)
+}
+
+func blobExists(hash string) bool {
+	fi, err := serveStorage.Stat(blobPath(hash))
+	return err == nil && !fi.IsDir()
+}
+
+// storeBlob copies r into the blob store and returns its digest. Content that
+// is already stored is dropped instead of being kept twice, and so is content
+// whose digest is not the expected one, when given.
+func storeBlob(r io.Reader, expected string) (string, error) {
+	var b [8]byte
+	rand.Read(b[:])
+	tmpName := path.Join(blobStorePath(), "tmp", "upload-"+hex.EncodeToString(b[:]))
+
+	h := sha256.New()
+	if err := serveStorage.Create(tmpName, io.TeeReader(r, h)); err != nil {
+		return "", err
+	}
+
+	hash := hex.EncodeToString(h.Sum(nil))
+	if expected != "" && expected != hash {
+		serveStorage.Delete(tmpName, false)
+		return "", errContentHashMismatch
+	}
+	if blobExists(hash) {
+		return hash, serveStorage.Delete(tmpName, false)
+	}
+	if err := serveStorage.Rename(tmpName, blobPath(hash)); err != nil {
+		serveStorage.Delete(tmpName, false)
+		return "", err
+	}
+	return hash, nil
+}
+
+// linkBlob makes the stored blob visible as destFileName.
+func linkBlob(hash string, destFileName string) error {
+	return serveStorage.Link(blobPath(hash), destFileName)
+}
+
+func blobStatHandler(w http.ResponseWriter, r *http.Request) {
+	hash := r.PathValue("hash")
+	if !regSHA256Hex.MatchString(hash) || !blobExists(hash) {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// blobLinkHandler links a stored blob under ?name=, an existing file of that
+// name is only replaced with ?overwrite=true.
+func blobLinkHandler(w http.ResponseWriter, r *http.Request) {
+	hash := r.PathValue("hash")
+	if !regSHA256Hex.MatchString(hash) || !blobExists(hash) {
+		http.NotFound(w, r)
+		return
+	}
+	name := filepath.Base(r.URL.Query().Get("name"))
+	if name == "." || name == string(filepath.Separator) || strings.ContainsAny(name, "\\\x00") {
+		writeFileError(w, errInvalidPath)
+		return
+	}
+	if _, err := serveStorage.Stat("/" + name); err == nil && r.URL.Query().Get("overwrite") != "true" {
+		writeFileError(w, fmt.Errorf("%s: %w", name, fs.ErrExist))
+		return
+	}
+	if err := linkBlob(hash, "/"+name); err != nil {
+		writeFileError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "Successfully Linked Existing Content\n")
+}
+
+func registerDedupHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/blobs/{hash}", requireAuth(blobStatHandler))
+	mux.HandleFunc("POST /api/blobs/{hash}", requireAuth(blobLinkHandler))
+}
+
+func fileSHA256(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func blobURL(uri string, hash string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	return u.ResolveReference(&url.URL{Path: "/api/blobs/" + hash}).String(), nil
+}
+
+// linkExistingBlobRequest asks the server whether it already holds content
+// with the given digest and, if so, links it under the file name so that the
+// upload can be skipped entirely.
+func linkExistingBlobRequest(uri string, filePath string, hash string, isHTTP3 bool) (bool, error) {
+	blobURI, err := blobURL(uri, hash)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest("GET", blobURI, nil)
+	if err != nil {
+		return false, err
+	}
+	SetRequestHeader(req)
+	client := getHTTPClient(isHTTP3)
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, nil
+	}
+
+	req, err = http.NewRequest("POST", blobURI+"?"+url.Values{"name": {filepath.Base(filePath)}}.Encode(), nil)
+	if err != nil {
+		return false, err
+	}
+	SetRequestHeader(req)
+	resp, err = client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusConflict {
+		// the name is taken, uploading replaces it as always
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, errors.New(resp.Status + ": " + strings.TrimSpace(string(body)))
+	}
+	logStdout.Printf("server already has %s (sha256 %s), %s", filePath, hash, string(body))
+	return true, nil
+}
@@ -8,7 +8,9 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -220,6 +222,9 @@ func downloadFileRequest(uri string, contentLength int64, filePath string, isHTT
 	} else {
 		concurrentThread = 1
 	}
+	if compressResponses {
+		return downloadCompressed(uri, contentLength, filePath, isHTTP3, tsBegin)
+	}
 
 	ctxt, cancel := context.WithCancel(context.Background())
 
@@ -240,6 +245,9 @@ func downloadFileRequest(uri string, contentLength int64, filePath string, isHTT
 		go downloadFileRequestAt(ctxtChild, uri, min, max, isHTTP3, output, done)
 	}
 
+	metrics := startClientMetrics(contentLength)
+	defer metrics.finish()
+
 	var totalReceived int64
 	for i := 0; i < concurrentThread && (err == nil || err == io.EOF); {
 		select {
@@ -259,7 +267,8 @@ func downloadFileRequest(uri string, contentLength int64, filePath string, isHTT
 			}
 			tsEnd := time.Now()
 			tsCost := tsEnd.Sub(tsBegin)
-			speed := totalReceived * 1000 / int64(tsCost/time.Millisecond)
+			speed := bytesPerSecond(totalReceived, tsCost)
+			metrics.update(totalReceived, tsCost)
 			englishPrinter.Printf("\rreceived and wrote %d/%d bytes to offset %d in %+v at %d B/s", totalReceived, contentLength, b.offset, tsCost, speed)
 		case err = <-done:
 			i++
@@ -274,9 +283,93 @@ func downloadFileRequest(uri string, contentLength int64, filePath string, isHTT
 	} else {
 		tsEnd := time.Now()
 		tsCost := tsEnd.Sub(tsBegin)
-		speed := totalReceived * 1000 / int64(tsCost/time.Millisecond)
+		speed := bytesPerSecond(totalReceived, tsCost)
 		logs := englishPrinter.Sprintf("%d bytes received and written to %s in %+v at %d B/s\n", totalReceived, filePath, tsCost, speed)
 		logStdout.Println(logs)
 	}
 	return err
 }
+
+// downloadCompressed fetches uri in a single request accepting zstd, br and
+// gzip and decodes the response on the fly. The response cannot be resumed
+// in the middle, a failed attempt starts over.
+func downloadCompressed(uri string, contentLength int64, filePath string, isHTTP3 bool, tsBegin time.Time) error {
+	metrics := startClientMetrics(contentLength)
+	defer metrics.finish()
+
+	var (
+		received int64
+		wire     atomic.Int64
+		encoding string
+		err      error
+	)
+	for retry := 1; ; retry++ {
+		wire.Store(0)
+		received, encoding, err = downloadCompressedOnce(uri, contentLength, isHTTP3, tsBegin, &wire, metrics)
+		if err == nil || (retryTimes >= 0 && retry >= retryTimes) {
+			break
+		}
+		logs := englishPrinter.Sprintf("\nreceived %d bytes but got error: %+v, retry it %d time\n", received, err, retry)
+		logStdout.Println(logs)
+	}
+	fmt.Printf("\n")
+	if err != nil {
+		logStderr.Println(err)
+		return err
+	}
+	if fd != nil {
+		fd.Truncate(received)
+	}
+	tsCost := time.Since(tsBegin)
+	speed := bytesPerSecond(received, tsCost)
+	logs := englishPrinter.Sprintf("%d bytes received as %d bytes of %s and written to %s in %+v at %d B/s\n", received, wire.Load(), ternaryOp(encoding != "", encoding, "identity"), filePath, tsCost, speed)
+	logStdout.Println(logs)
+	return nil
+}
+
+func downloadCompressedOnce(uri string, contentLength int64, isHTTP3 bool, tsBegin time.Time, wire *atomic.Int64, metrics *clientMetrics) (int64, string, error) {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	SetRequestHeader(req)
+	// set by hand, the transport would only ask for gzip
+	req.Header.Set("Accept-Encoding", strings.Join(responseEncodings, ", "))
+	resp, err := getHTTPClient(isHTTP3).Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, "", fmt.Errorf("download %s: %s", uri, resp.Status)
+	}
+	encoding := resp.Header.Get("Content-Encoding")
+	body, err := decodeBody(encoding, countingReadCloser{ReadCloser: resp.Body, counter: wire})
+	if err != nil {
+		return 0, encoding, err
+	}
+	defer body.Close()
+
+	buf := make([]byte, readBufSize)
+	var offset int64
+	for {
+		nr, er := body.Read(buf)
+		if nr > 0 {
+			if fd != nil {
+				if _, ew := fd.WriteAt(buf[:nr], offset); ew != nil {
+					return offset, encoding, ew
+				}
+			}
+			offset += int64(nr)
+			tsCost := time.Since(tsBegin)
+			metrics.update(offset, tsCost)
+			englishPrinter.Printf("\rreceived and wrote %d/%d bytes (%d bytes of %s) in %+v at %d B/s", offset, contentLength, wire.Load(), ternaryOp(encoding != "", encoding, "identity"), tsCost, bytesPerSecond(offset, tsCost))
+		}
+		if er == io.EOF {
+			return offset, encoding, nil
+		}
+		if er != nil {
+			return offset, encoding, er
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	forwardTCP = "tcp"
+	forwardUDP = "udp"
+
+	forwardDialTimeout   = 30 * time.Second
+	forwardUDPBufferSize = 64 * 1024
+)
+
+// forwardConn counts what is read from the connection and enforces the idle
+// timeout of a forwarded session. The session is idle when neither side has
+// sent anything for --relayIdleTimeout, so a read only times out when the
+// other direction was quiet as well.
+type forwardConn struct {
+	net.Conn
+	last    *atomic.Int64
+	counter prometheus.Counter
+}
+
+func (c *forwardConn) Read(p []byte) (int, error) {
+	for {
+		if relayIdleTimeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(relayIdleTimeout))
+		}
+		n, err := c.Conn.Read(p)
+		if n > 0 {
+			c.last.Store(time.Now().UnixNano())
+			c.counter.Add(float64(n))
+		}
+		if err != nil && errors.Is(err, os.ErrDeadlineExceeded) &&
+			time.Since(time.Unix(0, c.last.Load())) < relayIdleTimeout {
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *forwardConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.last.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// CloseWrite lets splice half-close the wrapped connection.
+func (c *forwardConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// relayConnLimit is --relayMaxConns, it can change when the configuration is
+// reloaded.
+var relayConnLimit atomic.Int64
+
+// connLimiter enforces --relayMaxConns on the connections or sessions of a
+// port mapping.
+type connLimiter struct {
+	open atomic.Int64
+}
+
+func (l *connLimiter) acquire() bool {
+	limit := relayConnLimit.Load()
+	if n := l.open.Add(1); limit > 0 && n > limit {
+		l.open.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (l *connLimiter) release() {
+	l.open.Add(-1)
+}
+
+// serveTCPForward splices the connections accepted on rp with its targets
+// until ctx is cancelled, then waits up to --shutdownTimeout for them.
+func serveTCPForward(ctx context.Context, rp *relayPort) error {
+	port := rp.port
+	ln, err := listenTCP(":" + port)
+	if err != nil {
+		return err
+	}
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		conns   = make(map[net.Conn]struct{})
+		limiter connLimiter
+	)
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return err
+		}
+		if !limiter.acquire() {
+			logStderr.Printf("WARN: Relay: :%s refused %s, %d connections open\n", port, conn.RemoteAddr(), relayConnLimit.Load())
+			conn.Close()
+			continue
+		}
+		mu.Lock()
+		conns[conn] = struct{}{}
+		mu.Unlock()
+		b := rp.balancer.Load()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer limiter.release()
+			forwardTCPConn(conn, port, b)
+			mu.Lock()
+			delete(conns, conn)
+			mu.Unlock()
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(shutdownTimeout):
+		mu.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		mu.Unlock()
+		return errShutdownTimeout
+	}
+}
+
+func forwardTCPConn(conn net.Conn, port string, b *balancer) {
+	defer conn.Close()
+	be := b.pick()
+	if be == nil {
+		logStderr.Printf("ERR: Relay: :%s %s: %v\n", port, conn.RemoteAddr(), errNoBackend)
+		return
+	}
+	be.active.Add(1)
+	defer be.active.Add(-1)
+	remote, err := net.DialTimeout("tcp", be.target.Host, forwardDialTimeout)
+	if err != nil {
+		logStderr.Printf("ERR: Relay: :%s %s: %v\n", port, conn.RemoteAddr(), err)
+		be.failed(err.Error())
+		return
+	}
+	defer remote.Close()
+	if relayProxyProto != "" {
+		if err = writeProxyHeader(remote, conn.RemoteAddr(), conn.LocalAddr()); err != nil {
+			logStderr.Printf("ERR: Relay: :%s %s: %v\n", port, conn.RemoteAddr(), err)
+			be.failed(err.Error())
+			return
+		}
+	}
+	be.worked()
+
+	relayForwardConnections.WithLabelValues(port, forwardTCP).Inc()
+	defer relayForwardConnections.WithLabelValues(port, forwardTCP).Dec()
+	last := &atomic.Int64{}
+	last.Store(time.Now().UnixNano())
+	tsBegin := time.Now()
+	sent, received := splice(
+		&forwardConn{Conn: conn, last: last, counter: relayForwardedBytes.WithLabelValues(port, forwardTCP, "in")},
+		&forwardConn{Conn: remote, last: last, counter: relayForwardedBytes.WithLabelValues(port, forwardTCP, "out")})
+	logStdout.Printf("INFO: Relay: tcp %s <-> %s closed after %s, %s\n", conn.RemoteAddr(), be.target.Host,
+		time.Since(tsBegin).Round(time.Millisecond), englishPrinter.Sprintf("%d bytes in, %d bytes out", received, sent))
+}
+
+// udpSession is the flow of datagrams between one client address and the
+// target picked for it.
+type udpSession struct {
+	client  *net.UDPAddr
+	backend *backend
+	remote  *net.UDPConn
+	last    atomic.Int64
+}
+
+// serveUDPForward relays the datagrams received on rp to its targets, every
+// client address sticks to one target until it is idle for
+// --relayIdleTimeout.
+func serveUDPForward(ctx context.Context, rp *relayPort) error {
+	port := rp.port
+	addr, err := net.ResolveUDPAddr("udp", ":"+port)
+	if err != nil {
+		return err
+	}
+	pc, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		sessions = make(map[string]*udpSession)
+		limiter  connLimiter
+		in       = relayForwardedBytes.WithLabelValues(port, forwardUDP, "in")
+	)
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+	}()
+	buf := make([]byte, forwardUDPBufferSize)
+	for {
+		n, client, err := pc.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return err
+		}
+		in.Add(float64(n))
+		key := client.String()
+		mu.Lock()
+		s := sessions[key]
+		mu.Unlock()
+		if s == nil {
+			if !limiter.acquire() {
+				continue
+			}
+			if s = openUDPSession(client, port, rp.balancer.Load()); s == nil {
+				limiter.release()
+				continue
+			}
+			mu.Lock()
+			sessions[key] = s
+			mu.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer limiter.release()
+				s.pump(pc, port)
+				mu.Lock()
+				delete(sessions, key)
+				mu.Unlock()
+			}()
+		}
+		s.last.Store(time.Now().UnixNano())
+		if _, err = s.remote.Write(buf[:n]); err != nil && !errors.Is(err, net.ErrClosed) {
+			s.backend.failed(err.Error())
+		}
+	}
+
+	// datagrams have nothing to drain, the sessions just end
+	mu.Lock()
+	for _, s := range sessions {
+		s.remote.Close()
+	}
+	mu.Unlock()
+	wg.Wait()
+	return nil
+}
+
+func openUDPSession(client *net.UDPAddr, port string, b *balancer) *udpSession {
+	be := b.pick()
+	if be == nil {
+		logStderr.Printf("ERR: Relay: :%s %s: %v\n", port, client, errNoBackend)
+		return nil
+	}
+	raddr, err := net.ResolveUDPAddr("udp", be.target.Host)
+	if err == nil {
+		var remote *net.UDPConn
+		if remote, err = net.DialUDP("udp", nil, raddr); err == nil {
+			s := &udpSession{client: client, backend: be, remote: remote}
+			s.last.Store(time.Now().UnixNano())
+			return s
+		}
+	}
+	logStderr.Printf("ERR: Relay: :%s %s: %v\n", port, client, err)
+	be.failed(err.Error())
+	return nil
+}
+
+// pump sends the answers of the target back to the client until the session
+// is idle or the target refuses the datagrams.
+func (s *udpSession) pump(pc *net.UDPConn, port string) {
+	defer s.remote.Close()
+	s.backend.active.Add(1)
+	defer s.backend.active.Add(-1)
+	relayForwardConnections.WithLabelValues(port, forwardUDP).Inc()
+	defer relayForwardConnections.WithLabelValues(port, forwardUDP).Dec()
+	out := relayForwardedBytes.WithLabelValues(port, forwardUDP, "out")
+	conn := &forwardConn{Conn: s.remote, last: &s.last, counter: out}
+	buf := make([]byte, forwardUDPBufferSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrDeadlineExceeded) && !errors.Is(err, net.ErrClosed) {
+				// ICMP port unreachable from the target
+				logStderr.Printf("ERR: Relay: :%s %s: %v\n", port, s.client, err)
+				s.backend.failed(err.Error())
+			}
+			return
+		}
+		s.backend.worked()
+		if _, err = pc.WriteToUDP(buf[:n], s.client); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+var (
+	// trustedProxies is --trustedProxy, the load balancers whose forwarding
+	// headers and PROXY protocol headers are believed
+	trustedProxies []netip.Prefix
+
+	forwardHeaderNames = []string{"x-forwarded", "forwarded", "none"}
+)
+
+// peerAddrKey keeps the address of the trusted proxy a request came through
+// once withClientIP replaced r.RemoteAddr with the client.
+type peerAddrKey struct{}
+
+// loadForwarding checks --trustedProxy, --relayForwardHeaders and
+// --relayProxyProtocol.
+func loadForwarding() error {
+	trustedProxies = nil
+	for _, s := range trustedProxySpecs {
+		prefix, err := parsePrefix(strings.TrimSpace(s))
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %s: %w", s, err)
+		}
+		trustedProxies = append(trustedProxies, prefix)
+	}
+	for _, name := range relayFwdHeaders {
+		if !slices.Contains(forwardHeaderNames, name) {
+			return fmt.Errorf("unsupported relay forward header %s, candidates: %s", name, strings.Join(forwardHeaderNames, ", "))
+		}
+	}
+	switch relayProxyProto {
+	case "", "v1", "v2":
+	default:
+		return fmt.Errorf("unsupported relay PROXY protocol version %s, candidates: v1, v2", relayProxyProto)
+	}
+	if acceptProxyProto && len(trustedProxies) == 0 {
+		return fmt.Errorf("--proxyProtocol needs --trustedProxy")
+	}
+	return nil
+}
+
+// containsAddr reports whether the IP of remoteAddr, with or without a port,
+// is in one of prefixes.
+func containsAddr(prefixes []netip.Prefix, remoteAddr string) bool {
+	addr, err := netip.ParseAddr(stripPort(remoteAddr))
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func isTrustedProxy(remoteAddr string) bool {
+	return containsAddr(trustedProxies, remoteAddr)
+}
+
+// withClientIP makes r.RemoteAddr the client a --trustedProxy forwarded the
+// request for, so that the access log and --allowIP see it instead of the
+// load balancer.
+func withClientIP(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if client := forwardedClient(r); client != "" {
+			peer := r.RemoteAddr
+			r = r.WithContext(context.WithValue(r.Context(), peerAddrKey{}, peer))
+			r.RemoteAddr = net.JoinHostPort(client, "0")
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// forwardedClient walks the Forwarded, or else X-Forwarded-For, chain of a
+// request from a trusted proxy backwards and returns the first address which
+// is not a trusted proxy itself. Anything before it may be made up.
+func forwardedClient(r *http.Request) string {
+	if !isTrustedProxy(r.RemoteAddr) {
+		return ""
+	}
+	chain := forwardedFor(r.Header)
+	for i := len(chain) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(chain[i])
+		if err != nil {
+			// unknown or obfuscated identifiers end the chain
+			return ""
+		}
+		if i == 0 || !isTrustedProxy(chain[i]) {
+			return addr.Unmap().String()
+		}
+	}
+	return ""
+}
+
+// forwardedFor lists the addresses of the for= parameters of Forwarded, or
+// of X-Forwarded-For, client first.
+func forwardedFor(h http.Header) []string {
+	var chain []string
+	if values := h.Values("Forwarded"); len(values) > 0 {
+		for _, element := range strings.Split(strings.Join(values, ","), ",") {
+			for _, pair := range strings.Split(element, ";") {
+				name, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if strings.EqualFold(name, "for") {
+					chain = append(chain, stripPort(strings.Trim(value, `"`)))
+				}
+			}
+		}
+		return chain
+	}
+	for _, v := range strings.Split(strings.Join(h.Values("X-Forwarded-For"), ","), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			chain = append(chain, v)
+		}
+	}
+	return chain
+}
+
+func sendsForwardHeader(name string) bool {
+	return slices.Contains(relayFwdHeaders, name)
+}
+
+// setForwardedHeaders tells relay targets about the client with the headers
+// of --relayForwardHeaders. httputil.ReverseProxy removed those of the
+// incoming request, they are only carried on when it comes from a
+// --trustedProxy, anyone else could claim any address.
+func setForwardedHeaders(pr *httputil.ProxyRequest) {
+	in, out := pr.In, pr.Out
+	peer := in.RemoteAddr
+	if p, ok := in.Context().Value(peerAddrKey{}).(string); ok {
+		peer = p
+	}
+	trusted := isTrustedProxy(peer)
+	prior := func(name string) string {
+		if !trusted {
+			return ""
+		}
+		return strings.Join(in.Header.Values(name), ", ")
+	}
+	peerIP := stripPort(peer)
+	proto := ternaryOp(in.TLS != nil, "https", "http")
+
+	if sendsForwardHeader("x-forwarded") {
+		xff := peerIP
+		if p := prior("X-Forwarded-For"); p != "" {
+			xff = p + ", " + peerIP
+		}
+		out.Header.Set("X-Forwarded-For", xff)
+		out.Header.Set("X-Forwarded-Proto", ternaryOp(prior("X-Forwarded-Proto") != "", prior("X-Forwarded-Proto"), proto))
+		out.Header.Set("X-Forwarded-Host", ternaryOp(prior("X-Forwarded-Host") != "", prior("X-Forwarded-Host"), in.Host))
+	}
+	if sendsForwardHeader("forwarded") {
+		node := peerIP
+		if strings.Contains(node, ":") {
+			node = `"[` + node + `]"`
+		}
+		element := fmt.Sprintf("for=%s;host=%q;proto=%s", node, in.Host, proto)
+		if p := prior("Forwarded"); p != "" {
+			element = p + ", " + element
+		}
+		out.Header.Set("Forwarded", element)
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// HAR 1.2 as described in http://www.softwareishard.com/blog/har-12-spec/,
+// only what can be observed from the proxy hooks is filled in.
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"_encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	User            string      `json:"_user,omitempty"`
+
+	requestBody *bodyCapture
+	requestType string
+	waitDone    time.Time
+}
+
+var (
+	harRecorder *harWriter
+	harHosts    []hostPattern
+	harURL      *regexp.Regexp
+)
+
+// harWriter keeps the HAR file a valid JSON document after every entry by
+// writing the closing brackets again behind each new entry.
+type harWriter struct {
+	mu      sync.Mutex
+	name    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+	entries int
+}
+
+const harFooter = "\n]}}\n"
+
+// openHAR sets up --har and its filters, it has to be called before proxy
+// mode starts serving.
+func openHAR() error {
+	for _, s := range harHostSpecs {
+		p, err := parseHostPattern(s)
+		if err != nil {
+			return fmt.Errorf("invalid HAR host filter %s: %w", s, err)
+		}
+		harHosts = append(harHosts, p)
+	}
+	if harURLPattern != "" {
+		re, err := regexp.Compile(harURLPattern)
+		if err != nil {
+			return fmt.Errorf("invalid HAR URL filter: %w", err)
+		}
+		harURL = re
+	}
+	w := &harWriter{name: harPath, maxSize: harMaxSize * 1024 * 1024, backups: harBackups}
+	// an existing capture is kept as a backup instead of being overwritten
+	if fi, err := os.Stat(harPath); err == nil && fi.Size() > 0 {
+		shiftBackups(harPath, harBackups)
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+	harRecorder = w
+	return nil
+}
+
+func (w *harWriter) open() error {
+	f, err := os.Create(w.name)
+	if err != nil {
+		return err
+	}
+	header := `{"log":{"version":"1.2","creator":{"name":"transfer","version":"1.0"},"entries":[`
+	if _, err = io.WriteString(f, header+harFooter); err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.size = int64(len(header) + len(harFooter))
+	w.entries = 0
+	return nil
+}
+
+func (w *harWriter) write(entry *harEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.maxSize > 0 && w.entries > 0 && w.size+int64(len(b)) > w.maxSize {
+		w.file.Close()
+		shiftBackups(w.name, w.backups)
+		if err = w.open(); err != nil {
+			return err
+		}
+	}
+	sep := "\n"
+	if w.entries > 0 {
+		sep = ",\n"
+	}
+	offset := w.size - int64(len(harFooter))
+	n, err := w.file.WriteAt([]byte(sep+string(b)+harFooter), offset)
+	if err != nil {
+		return err
+	}
+	w.size = offset + int64(n)
+	w.entries++
+	return nil
+}
+
+// shouldRecordHAR applies --harHost and --harURL to req.
+func shouldRecordHAR(req *http.Request) bool {
+	if harRecorder == nil {
+		return false
+	}
+	if len(harHosts) > 0 {
+		matched := false
+		for _, p := range harHosts {
+			if p.match(req.URL.Host) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return harURL == nil || harURL.MatchString(req.URL.String())
+}
+
+// bodyCapture keeps the first --harBodySize bytes of a body while it is
+// streamed through the proxy, and counts all of them.
+type bodyCapture struct {
+	io.ReadCloser
+	buf     []byte
+	size    int64
+	onClose func()
+	once    sync.Once
+}
+
+func (c *bodyCapture) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if room := harBodySize - int64(len(c.buf)); room > 0 {
+		c.buf = append(c.buf, p[:min(int64(n), room)]...)
+	}
+	c.size += int64(n)
+	if err == io.EOF {
+		c.finish()
+	}
+	return n, err
+}
+
+func (c *bodyCapture) Close() error {
+	err := c.ReadCloser.Close()
+	c.finish()
+	return err
+}
+
+func (c *bodyCapture) finish() {
+	if c.onClose != nil {
+		c.once.Do(c.onClose)
+	}
+}
+
+// text returns the captured body the way HAR expects it, binary content is
+// base64 encoded.
+func (c *bodyCapture) text() (text, encoding, comment string) {
+	if c.size > int64(len(c.buf)) {
+		comment = fmt.Sprintf("truncated to %d of %d bytes", len(c.buf), c.size)
+	}
+	if utf8.Valid(c.buf) {
+		return string(c.buf), "", comment
+	}
+	return base64.StdEncoding.EncodeToString(c.buf), "base64", comment
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	values := []harNameValue{}
+	for name, vv := range h {
+		for _, v := range vv {
+			values = append(values, harNameValue{Name: name, Value: v})
+		}
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].Name < values[j].Name })
+	return values
+}
+
+func harCookies(cookies []*http.Cookie) []harNameValue {
+	values := []harNameValue{}
+	for _, c := range cookies {
+		values = append(values, harNameValue{Name: c.Name, Value: c.Value})
+	}
+	return values
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// startHAREntry records req, called from onRequest before it is sent
+// upstream.
+func startHAREntry(req *http.Request, user string) *harEntry {
+	entry := &harEntry{
+		StartedDateTime: time.Now(),
+		User:            user,
+		requestType:     req.Header.Get("Content-Type"),
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         req.URL.String(),
+			HTTPVersion: req.Proto,
+			Cookies:     harCookies(req.Cookies()),
+			Headers:     harHeaders(req.Header),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    0,
+		},
+	}
+	for name, vv := range req.URL.Query() {
+		for _, v := range vv {
+			entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{Name: name, Value: v})
+		}
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		entry.requestBody = &bodyCapture{ReadCloser: req.Body}
+		req.Body = entry.requestBody
+	}
+	return entry
+}
+
+// finishHAREntry records resp, called from onResponse. The entry is written
+// once the client has received the whole body.
+func finishHAREntry(entry *harEntry, resp *http.Response) {
+	entry.waitDone = time.Now()
+	if c := entry.requestBody; c != nil {
+		entry.Request.BodySize = c.size
+		if harBodySize > 0 {
+			text, encoding, comment := c.text()
+			entry.Request.PostData = &harPostData{MimeType: entry.requestType, Text: text, Encoding: encoding, Comment: comment}
+		}
+	}
+	entry.Response = harResponse{
+		Status:      resp.StatusCode,
+		StatusText:  http.StatusText(resp.StatusCode),
+		HTTPVersion: resp.Proto,
+		Cookies:     harCookies(resp.Cookies()),
+		Headers:     harHeaders(resp.Header),
+		Content:     harContent{MimeType: resp.Header.Get("Content-Type")},
+		RedirectURL: resp.Header.Get("Location"),
+		HeadersSize: -1,
+	}
+
+	body := &bodyCapture{ReadCloser: resp.Body}
+	body.onClose = func() {
+		done := time.Now()
+		entry.Response.BodySize = body.size
+		entry.Response.Content.Size = body.size
+		if harBodySize > 0 {
+			entry.Response.Content.Text, entry.Response.Content.Encoding, entry.Response.Content.Comment = body.text()
+		}
+		entry.Timings.Wait = milliseconds(entry.waitDone.Sub(entry.StartedDateTime))
+		entry.Timings.Receive = milliseconds(done.Sub(entry.waitDone))
+		entry.Time = milliseconds(done.Sub(entry.StartedDateTime))
+		if err := harRecorder.write(entry); err != nil {
+			logStderr.Println("ERR: HAR:", err)
+		}
+	}
+	resp.Body = body
+}
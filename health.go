@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	errNoBackend = errors.New("no healthy relay backend")
+
+	// relayMappings lists the balancers of all relay port mappings for the
+	// status page.
+	relayMappingsMu sync.Mutex
+	relayMappings   []relayMapping
+)
+
+type relayMapping struct {
+	Port     string
+	Route    string
+	balancer *balancer
+}
+
+// backendHealth tracks whether a backend is taking requests. Passive checks
+// take it down after --relayMaxFails consecutive failed requests, unless it
+// is the last one of its mapping still up, active checks after as many
+// failed probes. Without active checks a down backend
+// gets a request again after --relayFailTimeout, with them the first
+// successful probe brings it back.
+type backendHealth struct {
+	mu        sync.Mutex
+	down      bool
+	fails     int
+	changed   time.Time
+	retryAt   time.Time
+	lastError string
+	lastProbe time.Time
+}
+
+func (be *backend) available(now time.Time) bool {
+	be.health.mu.Lock()
+	defer be.health.mu.Unlock()
+	return !be.health.down || (relayHealthPath == "" && now.After(be.health.retryAt))
+}
+
+func (be *backend) succeeded() {
+	h := &be.health
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.fails = 0
+	if h.down {
+		h.down = false
+		h.changed = time.Now()
+		logStdout.Printf("INFO: Relay: backend %s is up\n", be.target.Redacted())
+		relayBackendUp.WithLabelValues(be.pool.port, be.pool.route, be.target.Host).Set(1)
+	}
+}
+
+func (be *backend) failed(reason string) {
+	be.fail(reason, true)
+}
+
+// failedRequest records a failed relayed request. The last backend of a
+// mapping which is up stays so, its own answer beats a 503 of the relay.
+func (be *backend) failedRequest(reason string) {
+	be.fail(reason, be.pool.othersAvailable(be))
+}
+
+func (be *backend) fail(reason string, eject bool) {
+	h := &be.health
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.fails++
+	h.lastError = reason
+	if h.fails < relayMaxFails || !eject {
+		return
+	}
+	h.retryAt = time.Now().Add(relayFailTimeout)
+	if !h.down {
+		h.down = true
+		h.changed = time.Now()
+		logStderr.Printf("WARN: Relay: backend %s is down after %d failures: %s\n", be.target.Redacted(), h.fails, reason)
+		relayBackendUp.WithLabelValues(be.pool.port, be.pool.route, be.target.Host).Set(0)
+	}
+}
+
+// isBackendFailure tells which answers count against a backend for passive
+// health checks, besides failing to answer at all.
+func isBackendFailure(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+// probeBackends runs the --relayHealthPath checks of b until ctx is done.
+func probeBackends(ctx context.Context, b *balancer) {
+	client := &http.Client{
+		Timeout:   relayHealthTimeout,
+		Transport: targetTransport(),
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	ticker := time.NewTicker(relayProbeInterval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, be := range b.backends {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				probeBackend(ctx, client, be)
+			}()
+		}
+		wg.Wait()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func probeBackend(ctx context.Context, client *http.Client, be *backend) {
+	if be.target.Scheme == forwardTCP {
+		// TCP targets only have to accept connections
+		dialer := &net.Dialer{Timeout: relayHealthTimeout}
+		conn, err := dialer.DialContext(ctx, "tcp", be.target.Host)
+		be.health.mu.Lock()
+		be.health.lastProbe = time.Now()
+		be.health.mu.Unlock()
+		if err != nil {
+			if ctx.Err() == nil {
+				be.failed(err.Error())
+			}
+			return
+		}
+		conn.Close()
+		be.succeeded()
+		return
+	}
+	u := *be.target
+	u.Path = singleJoiningSlash(u.Path, relayHealthPath)
+	u.RawPath = ""
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		be.failed(err.Error())
+		return
+	}
+	req.Header.Set("User-Agent", "transfer-health-check")
+	resp, err := client.Do(req)
+	be.health.mu.Lock()
+	be.health.lastProbe = time.Now()
+	be.health.mu.Unlock()
+	if err != nil {
+		if ctx.Err() == nil {
+			be.failed(err.Error())
+		}
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != relayHealthStatus {
+		be.failed("health check returned " + resp.Status)
+		return
+	}
+	be.succeeded()
+}
+
+func singleJoiningSlash(a, b string) string {
+	switch aslash, bslash := len(a) > 0 && a[len(a)-1] == '/', len(b) > 0 && b[0] == '/'; {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+type backendStatus struct {
+	Target    string    `json:"target"`
+	Weight    int       `json:"weight"`
+	Healthy   bool      `json:"healthy"`
+	Active    int64     `json:"active"`
+	Fails     int       `json:"fails"`
+	Since     time.Time `json:"since,omitempty"`
+	LastError string    `json:"lastError,omitempty"`
+	LastProbe time.Time `json:"lastProbe,omitempty"`
+}
+
+type mappingStatus struct {
+	Port     string          `json:"port"`
+	Route    string          `json:"route"`
+	Strategy string          `json:"strategy"`
+	Backends []backendStatus `json:"backends"`
+}
+
+func relayStatus() []mappingStatus {
+	relayMappingsMu.Lock()
+	defer relayMappingsMu.Unlock()
+	var status []mappingStatus
+	for _, m := range relayMappings {
+		ms := mappingStatus{Port: m.Port, Route: m.Route, Strategy: m.balancer.strategy}
+		for _, be := range m.balancer.backends {
+			be.health.mu.Lock()
+			ms.Backends = append(ms.Backends, backendStatus{
+				Target:    be.target.Redacted(),
+				Weight:    be.weight,
+				Healthy:   !be.health.down,
+				Active:    be.active.Load(),
+				Fails:     be.health.fails,
+				Since:     be.health.changed,
+				LastError: be.health.lastError,
+				LastProbe: be.health.lastProbe,
+			})
+			be.health.mu.Unlock()
+		}
+		status = append(status, ms)
+	}
+	return status
+}
+
+var relayStatusPage = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Relay status</title><meta http-equiv="refresh" content="10"></head>
+<body>
+{{range .}}<h2>:{{.Port}} {{.Route}} ({{.Strategy}})</h2>
+<table border="1" cellpadding="4">
+<tr><th>Backend</th><th>Weight</th><th>Health</th><th>In flight</th><th>Failures</th><th>Since</th><th>Last probe</th><th>Last error</th></tr>
+{{range .Backends}}<tr><td>{{.Target}}</td><td>{{.Weight}}</td><td>{{if .Healthy}}up{{else}}<b>down</b>{{end}}</td><td>{{.Active}}</td><td>{{.Fails}}</td><td>{{if not .Since.IsZero}}{{.Since.Format "2006-01-02 15:04:05"}}{{end}}</td><td>{{if not .LastProbe.IsZero}}{{.LastProbe.Format "2006-01-02 15:04:05"}}{{end}}</td><td>{{.LastError}}</td></tr>
+{{end}}</table>
+{{end}}</body>
+</html>
+`))
+
+// serveRelayStatus shows the backend health of relay mode on
+// --relayStatusListen, as HTML or with ?format=json as JSON.
+func serveRelayStatus(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		status := relayStatus()
+		if r.URL.Query().Get("format") == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(status)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := relayStatusPage.Execute(w, status); err != nil {
+			logStderr.Println("ERR: Relay: status page:", err)
+		}
+	})
+	s := &http.Server{Addr: relayStatusAddr, Handler: mux}
+	logStdout.Println("Serving relay status at", relayStatusAddr)
+	go func() {
+		if err := serveUntilDone(ctx, s, s.ListenAndServe); err != nil {
+			logStderr.Println("relay status:", err)
+		}
+	}()
+}
+
+// recordBackendResult feeds a relayed request into the passive checks.
+func recordBackendResult(be *backend, resp *http.Response, err error) {
+	switch {
+	case err != nil:
+		if !errors.Is(err, context.Canceled) {
+			be.failedRequest(err.Error())
+		}
+	case isBackendFailure(resp.StatusCode):
+		be.failedRequest("answered " + strconv.Itoa(resp.StatusCode))
+	default:
+		be.worked()
+	}
+}
+
+// worked records a request the backend served.
+func (be *backend) worked() {
+	if relayHealthPath == "" {
+		be.succeeded()
+		return
+	}
+	// with active checks only probes bring a backend back
+	be.health.mu.Lock()
+	be.health.fails = 0
+	be.health.mu.Unlock()
+}
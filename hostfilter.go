@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+)
+
+const defaultBlockPage = `<!DOCTYPE html>
+<html>
+<head><title>Access denied</title></head>
+<body>
+<h1>Access denied</h1>
+<p>The proxy does not allow access to <b>{{.Host}}</b>: {{.Reason}}.</p>
+<p>Client {{.Client}}{{if .User}}, user {{.User}}{{end}}, {{.Time}}</p>
+</body>
+</html>
+`
+
+var (
+	allowedHosts []hostPattern
+	deniedHosts  []hostPattern
+	// names are only resolved when the lists contain addresses
+	resolveFilteredHosts bool
+	blockPage            *template.Template
+)
+
+// blockPageData is what --blockPage templates can use.
+type blockPageData struct {
+	Host   string
+	URL    string
+	Reason string
+	Client string
+	User   string
+	Time   string
+}
+
+// loadHostFilter parses --allowHost, --denyHost and --blockPage. Entries of
+// the lists starting with @ name files with one pattern per line.
+func loadHostFilter() (err error) {
+	if allowedHosts, err = readHostPatterns(allowHostSpecs); err != nil {
+		return err
+	}
+	if deniedHosts, err = readHostPatterns(denyHostSpecs); err != nil {
+		return err
+	}
+	for _, patterns := range [][]hostPattern{allowedHosts, deniedHosts} {
+		for _, p := range patterns {
+			resolveFilteredHosts = resolveFilteredHosts || p.prefix.IsValid()
+		}
+	}
+	page := defaultBlockPage
+	if blockPagePath != "" {
+		b, err := os.ReadFile(blockPagePath)
+		if err != nil {
+			return err
+		}
+		page = string(b)
+	}
+	if blockPage, err = template.New("block").Parse(page); err != nil {
+		return fmt.Errorf("invalid block page: %w", err)
+	}
+	return nil
+}
+
+func readHostPatterns(specs []string) ([]hostPattern, error) {
+	var patterns []hostPattern
+	add := func(s, source string) error {
+		p, err := parseHostPattern(s)
+		if err != nil {
+			return fmt.Errorf("invalid host pattern %s%s: %w", s, source, err)
+		}
+		patterns = append(patterns, p)
+		return nil
+	}
+	for _, spec := range specs {
+		name, ok := strings.CutPrefix(spec, "@")
+		if !ok {
+			if err := add(spec, ""); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(b))
+		for line := 1; scanner.Scan(); line++ {
+			s, _, _ := strings.Cut(scanner.Text(), "#")
+			if s = strings.TrimSpace(s); s != "" {
+				if err = add(s, fmt.Sprintf(" in %s:%d", name, line)); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return patterns, nil
+}
+
+func matchesAny(patterns []hostPattern, host string, addrs []netip.Addr) bool {
+	for _, p := range patterns {
+		if p.match(host) {
+			return true
+		}
+		for _, addr := range addrs {
+			if p.matchAddr(addr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkHost applies the allow and deny lists to host, with or without port.
+// Denied wins over allowed, and with an allow list only what it lists may be
+// reached. It returns why host is refused, or an empty string.
+func checkHost(ctx context.Context, host string) string {
+	if len(allowedHosts) == 0 && len(deniedHosts) == 0 {
+		return ""
+	}
+	var addrs []netip.Addr
+	if name := stripPort(host); resolveFilteredHosts {
+		if _, err := netip.ParseAddr(name); err != nil {
+			ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			addrs, err = net.DefaultResolver.LookupNetIP(ctx, "ip", name)
+			cancel()
+			if err != nil {
+				// an upstream proxy might still resolve it, to an address
+				// that is denied
+				return "cannot be resolved"
+			}
+		}
+	}
+	if matchesAny(deniedHosts, host, addrs) {
+		return "denied by policy"
+	}
+	if len(allowedHosts) > 0 && !matchesAny(allowedHosts, host, addrs) {
+		return "not in the allowed list"
+	}
+	return ""
+}
+
+// writeBlockPage answers a request for a refused host with --blockPage.
+func writeBlockPage(w http.ResponseWriter, r *http.Request, user, reason string) {
+	data := blockPageData{
+		Host:   stripPort(r.URL.Host),
+		URL:    r.URL.String(),
+		Reason: reason,
+		Client: r.RemoteAddr,
+		User:   user,
+		Time:   time.Now().Format(time.RFC1123),
+	}
+	if r.Method == http.MethodConnect {
+		data.URL = r.URL.Host
+	}
+	var buf bytes.Buffer
+	if err := blockPage.Execute(&buf, data); err != nil {
+		logStderr.Println("ERR: Proxy: block page:", err)
+		http.Error(w, reason, http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	w.Write(buf.Bytes())
+}
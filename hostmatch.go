@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// hostPattern matches a host name or address. Supported forms are "*" for
+// everything, "*.example.com" for all subdomains, ".example.com" for the
+// domain and its subdomains, an exact name, an IP address or a CIDR. IPs and
+// CIDRs only match hosts given as addresses, names are never resolved.
+type hostPattern struct {
+	raw    string
+	any    bool
+	name   string
+	suffix string
+	prefix netip.Prefix
+}
+
+func parseHostPattern(s string) (hostPattern, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	p := hostPattern{raw: s}
+	switch {
+	case s == "*":
+		p.any = true
+	case strings.HasPrefix(s, "*."):
+		p.suffix = s[1:]
+	case strings.HasPrefix(s, "."):
+		p.name = s[1:]
+		p.suffix = s
+	default:
+		if prefix, err := parsePrefix(s); err == nil {
+			p.prefix = prefix
+			break
+		} else if strings.Contains(s, "/") {
+			return p, err
+		}
+		p.name = s
+	}
+	return p, nil
+}
+
+// match reports whether host, with or without port, matches the pattern.
+func (p hostPattern) match(host string) bool {
+	host = strings.ToLower(stripPort(host))
+	switch {
+	case p.any:
+		return true
+	case p.prefix.IsValid():
+		addr, err := netip.ParseAddr(host)
+		return err == nil && p.prefix.Contains(addr.Unmap())
+	case p.name != "" && host == p.name:
+		return true
+	case p.suffix != "":
+		return strings.HasSuffix(host, p.suffix)
+	}
+	return false
+}
+
+// matchAddr reports whether the address a host name resolved to matches an
+// IP or CIDR pattern.
+func (p hostPattern) matchAddr(addr netip.Addr) bool {
+	return p.prefix.IsValid() && p.prefix.Contains(addr.Unmap())
+}
+
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
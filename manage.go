@@ -0,0 +1,293 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var errInvalidPath = errors.New("invalid path")
+
+// resolveServePath cleans a slash separated request path into a storage
+// name, refusing the root itself and the hidden bookkeeping directories.
+func resolveServePath(p string) (string, error) {
+	if strings.ContainsAny(p, "\\\x00") {
+		return "", errInvalidPath
+	}
+	cleaned := path.Clean("/" + p)
+	if cleaned == "/" || (storageFS{hidden: hiddenServePaths()}).isHidden(cleaned) {
+		return "", errInvalidPath
+	}
+	return cleaned, nil
+}
+
+func writeFileError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errInvalidPath):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, fs.ErrNotExist):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, fs.ErrExist):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// moveToTrash keeps the relative layout of the deleted entry below a
+// timestamped directory of --trash so that it can be restored by hand. The
+// trash is a local directory whatever the storage, entries of other
+// storages are copied there before they are deleted.
+func moveToTrash(name string, isDir bool) error {
+	dest := filepath.Join(trashPath, time.Now().Format("20060102-150405.000"), filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if s, ok := serveStorage.(localStorage); ok {
+		return os.Rename(s.path(name), dest)
+	}
+	if err := copyToLocal(name, dest, isDir); err != nil {
+		return err
+	}
+	return serveStorage.Delete(name, isDir)
+}
+
+// trashStorageName returns the storage name of --trash when it lies inside
+// the local storage.
+func trashStorageName() (string, bool) {
+	s, ok := serveStorage.(localStorage)
+	if !ok || trashPath == "" {
+		return "", false
+	}
+	root, err1 := filepath.Abs(s.root)
+	trash, err2 := filepath.Abs(trashPath)
+	if err1 != nil || err2 != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(root, trash)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return path.Clean("/" + filepath.ToSlash(rel)), true
+}
+
+// copyToLocal copies the storage entry name, with all it contains, to the
+// local path dest.
+func copyToLocal(name, dest string, isDir bool) error {
+	if !isDir {
+		rc, err := serveStorage.OpenRange(name, 0, -1)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		f, err := os.Create(dest)
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(f, rc); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	entries, err := serveStorage.List(name)
+	if err != nil {
+		return err
+	}
+	for _, fi := range entries {
+		if err := copyToLocal(path.Join(name, fi.Name()), filepath.Join(dest, fi.Name()), fi.IsDir()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteFileHandler(w http.ResponseWriter, r *http.Request) {
+	name, err := resolveServePath(r.PathValue("path"))
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	fi, err := serveStorage.Stat(name)
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	if fi.IsDir() && r.URL.Query().Get("recursive") != "true" {
+		entries, err := serveStorage.List(name)
+		if err != nil {
+			writeFileError(w, err)
+			return
+		}
+		if len(entries) > 0 {
+			http.Error(w, "directory is not empty", http.StatusConflict)
+			return
+		}
+	}
+
+	if trashPath != "" {
+		err = moveToTrash(name, fi.IsDir())
+	} else {
+		err = serveStorage.Delete(name, fi.IsDir())
+	}
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "Successfully Deleted %s\n", strings.TrimPrefix(name, "/"))
+}
+
+func mkdirHandler(w http.ResponseWriter, r *http.Request) {
+	name, err := resolveServePath(r.PathValue("path"))
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	if err = serveStorage.Mkdir(name); err != nil {
+		writeFileError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "Successfully Created %s\n", strings.TrimPrefix(name, "/"))
+}
+
+func renameEntry(w http.ResponseWriter, src, dest string) {
+	if _, err := serveStorage.Stat(src); err != nil {
+		writeFileError(w, err)
+		return
+	}
+	// like mv, moving onto an existing directory moves the entry into it
+	if fi, err := serveStorage.Stat(dest); err == nil && fi.IsDir() {
+		dest = path.Join(dest, path.Base(src))
+	}
+	if _, err := serveStorage.Stat(dest); err == nil {
+		writeFileError(w, fmt.Errorf("%s: %w", path.Base(dest), fs.ErrExist))
+		return
+	}
+	if err := serveStorage.Rename(src, dest); err != nil {
+		writeFileError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "Successfully Moved to %s\n", strings.TrimPrefix(dest, "/"))
+}
+
+func moveFileHandler(w http.ResponseWriter, r *http.Request) {
+	src, err := resolveServePath(r.PathValue("path"))
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	dest, err := resolveServePath(r.URL.Query().Get("to"))
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	renameEntry(w, src, dest)
+}
+
+func renameFileHandler(w http.ResponseWriter, r *http.Request) {
+	src, err := resolveServePath(r.PathValue("path"))
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	newName := r.URL.Query().Get("name")
+	if newName == "" || newName == "." || newName == ".." || strings.ContainsAny(newName, "/\\\x00") {
+		writeFileError(w, errInvalidPath)
+		return
+	}
+	dest, err := resolveServePath(path.Join(path.Dir(src), newName))
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	renameEntry(w, src, dest)
+}
+
+func registerFileManageHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("DELETE /api/files/{path...}", requireAuth(deleteFileHandler))
+	mux.HandleFunc("POST /api/mkdir/{path...}", requireAuth(mkdirHandler))
+	mux.HandleFunc("POST /api/move/{path...}", requireAuth(moveFileHandler))
+	mux.HandleFunc("POST /api/rename/{path...}", requireAuth(renameFileHandler))
+}
+
+func fileManageRequest(method string, uri string, isHTTP3 bool) error {
+	req, err := http.NewRequest(method, uri, nil)
+	if err != nil {
+		logStderr.Println(err)
+		return err
+	}
+	SetRequestHeader(req)
+	client := getHTTPClient(isHTTP3)
+	resp, err := client.Do(req)
+	if err != nil {
+		logStderr.Println(err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		logStderr.Println(err)
+		return err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		err = fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+		logStderr.Println(err)
+		return err
+	}
+	logStdout.Print(string(body))
+	return nil
+}
+
+func fileManageURL(action string, p string, query url.Values) (string, error) {
+	u, err := url.Parse(serverAddr)
+	if err != nil {
+		return "", err
+	}
+	u = u.JoinPath("api", action, p)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+func removeFileRequest(p string, isHTTP3 bool) error {
+	query := url.Values{}
+	if recursive {
+		query.Set("recursive", "true")
+	}
+	uri, err := fileManageURL("files", p, query)
+	if err != nil {
+		logStderr.Println(err)
+		return err
+	}
+	return fileManageRequest(http.MethodDelete, uri, isHTTP3)
+}
+
+func mkdirRequest(p string, isHTTP3 bool) error {
+	uri, err := fileManageURL("mkdir", p, nil)
+	if err != nil {
+		logStderr.Println(err)
+		return err
+	}
+	return fileManageRequest(http.MethodPost, uri, isHTTP3)
+}
+
+func moveFileRequest(src, dest string, isHTTP3 bool) error {
+	uri, err := fileManageURL("move", src, url.Values{"to": {dest}})
+	if err != nil {
+		logStderr.Println(err)
+		return err
+	}
+	return fileManageRequest(http.MethodPost, uri, isHTTP3)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "transfer_requests_total",
+		Help: "HTTP requests served, by work mode, protocol and status code.",
+	}, []string{"mode", "protocol", "code"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "transfer_request_duration_seconds",
+		Help:    "Time spent serving HTTP requests.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"mode", "protocol"})
+	receivedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "transfer_received_bytes_total",
+		Help: "Request body bytes received from clients.",
+	}, []string{"mode"})
+	sentBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "transfer_sent_bytes_total",
+		Help: "Response bytes sent to clients.",
+	}, []string{"mode"})
+	uploadDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "transfer_upload_duration_seconds",
+		Help:    "Time spent receiving and storing uploaded files in server mode.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+	})
+	downloadDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "transfer_download_duration_seconds",
+		Help:    "Time spent sending files in server mode.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+	})
+	activeConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "transfer_active_connections",
+		Help: "Open client connections, by transport.",
+	}, []string{"transport"})
+	proxyUpstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "transfer_proxy_upstream_errors_total",
+		Help: "Errors talking to upstream servers in proxy mode.",
+	}, []string{"where"})
+	proxyCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "transfer_proxy_cache_requests_total",
+		Help: "Cacheable requests in proxy mode, by cache result.",
+	}, []string{"result"})
+	proxyCacheSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "transfer_proxy_cache_size_bytes",
+		Help: "Size of the bodies in the proxy cache.",
+	})
+	relayBackendDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "transfer_relay_backend_duration_seconds",
+		Help:    "Time until relay backends returned response headers.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"backend", "code"})
+
+	relayForwardedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "transfer_relay_forwarded_bytes_total",
+		Help: "Bytes forwarded by tcp:// and udp:// relay mappings, in from clients and out to them.",
+	}, []string{"port", "protocol", "direction"})
+	relayForwardConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "transfer_relay_forward_connections",
+		Help: "Open tcp:// connections and udp:// sessions of relay mappings.",
+	}, []string{"port", "protocol"})
+	relayBackendUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "transfer_relay_backend_up",
+		Help: "Whether relay backends pass their health checks.",
+	}, []string{"port", "route", "backend"})
+
+	clientDownloadedBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "transfer_client_downloaded_bytes",
+		Help: "Bytes received by the running download.",
+	})
+	clientDownloadSizeBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "transfer_client_download_size_bytes",
+		Help: "Expected size of the running download.",
+	})
+	clientDownloadSpeed = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "transfer_client_download_speed_bytes_per_second",
+		Help: "Average speed of the running download.",
+	})
+	clientDownloadStartTime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "transfer_client_download_start_time_seconds",
+		Help: "Unix time the running download started at.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requestsTotal,
+		requestDuration,
+		receivedBytes,
+		sentBytes,
+		uploadDuration,
+		downloadDuration,
+		activeConnections,
+		proxyUpstreamErrors,
+		proxyCacheRequests,
+		proxyCacheSize,
+		relayBackendDuration,
+		relayBackendUp,
+		relayForwardedBytes,
+		relayForwardConnections,
+	)
+}
+
+// serveMetrics exposes /metrics on --metricsListen, apart from the served
+// traffic so that it can be firewalled separately.
+func serveMetrics(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	s := &http.Server{Addr: metricsListenAddr, Handler: mux}
+	logStdout.Println("Serving metrics at", metricsListenAddr)
+	go func() {
+		if err := serveUntilDone(ctx, s, s.ListenAndServe); err != nil {
+			logStderr.Println("metrics:", err)
+		}
+	}()
+}
+
+type countingReadCloser struct {
+	io.ReadCloser
+	counter *atomic.Int64
+}
+
+func (c countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.counter.Add(int64(n))
+	return n, err
+}
+
+// withMetrics counts requests and traffic of h for the given work mode.
+func withMetrics(mode string, h http.Handler) http.Handler {
+	if metricsListenAddr == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tsBegin := time.Now()
+		rw := &recordingResponseWriter{ResponseWriter: w}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = countingReadCloser{ReadCloser: r.Body, counter: &rw.received}
+		}
+
+		h.ServeHTTP(rw, r)
+
+		status := rw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		proto := protocolName(r)
+		requestsTotal.WithLabelValues(mode, proto, strconv.Itoa(status)).Inc()
+		requestDuration.WithLabelValues(mode, proto).Observe(time.Since(tsBegin).Seconds())
+		receivedBytes.WithLabelValues(mode).Add(float64(rw.received.Load()))
+		sentBytes.WithLabelValues(mode).Add(float64(rw.sent.Load()))
+	})
+}
+
+// instrument wraps h with the access log and metrics middlewares, which see
+// the client behind a --trustedProxy.
+func instrument(mode string, h http.Handler) http.Handler {
+	return withClientIP(withAccessLog(withMetrics(mode, h)))
+}
+
+// trackConnState keeps transfer_active_connections up to date for TCP,
+// it is meant to be used as http.Server.ConnState.
+func trackConnState(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		activeConnections.WithLabelValues("tcp").Inc()
+	case http.StateHijacked, http.StateClosed:
+		activeConnections.WithLabelValues("tcp").Dec()
+	}
+}
+
+// countingQUICListener does for QUIC what trackConnState does for TCP.
+type countingQUICListener struct {
+	http3.QUICEarlyListener
+}
+
+func (ln countingQUICListener) Accept(ctx context.Context) (quic.EarlyConnection, error) {
+	conn, err := ln.QUICEarlyListener.Accept(ctx)
+	if err != nil {
+		return conn, err
+	}
+	activeConnections.WithLabelValues("quic").Inc()
+	go func() {
+		<-conn.Context().Done()
+		activeConnections.WithLabelValues("quic").Dec()
+	}()
+	return conn, nil
+}
+
+// instrumentedTransport observes how long relay backends take to answer.
+type instrumentedTransport struct {
+	http.RoundTripper
+}
+
+func (t instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tsBegin := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(req)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	relayBackendDuration.WithLabelValues(req.URL.Host, code).Observe(time.Since(tsBegin).Seconds())
+	return resp, err
+}
+
+// clientMetrics tracks a running download and periodically writes it to
+// --metricsTextfile for the node_exporter textfile collector.
+type clientMetrics struct {
+	registry *prometheus.Registry
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func startClientMetrics(contentLength int64) *clientMetrics {
+	if metricsTextfile == "" {
+		return nil
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(clientDownloadedBytes, clientDownloadSizeBytes, clientDownloadSpeed, clientDownloadStartTime)
+	clientDownloadSizeBytes.Set(float64(contentLength))
+	clientDownloadStartTime.SetToCurrentTime()
+
+	cm := &clientMetrics{registry: registry, stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(cm.done)
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				cm.write()
+			case <-cm.stop:
+				cm.write()
+				return
+			}
+		}
+	}()
+	return cm
+}
+
+func (cm *clientMetrics) update(received int64, cost time.Duration) {
+	if cm == nil {
+		return
+	}
+	clientDownloadedBytes.Set(float64(received))
+	clientDownloadSpeed.Set(float64(bytesPerSecond(received, cost)))
+}
+
+func (cm *clientMetrics) write() {
+	if err := prometheus.WriteToTextfile(metricsTextfile, cm.registry); err != nil {
+		logStderr.Println(err)
+	}
+}
+
+func (cm *clientMetrics) finish() {
+	if cm == nil {
+		return
+	}
+	close(cm.stop)
+	<-cm.done
+}
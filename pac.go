@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// isPACRequest tells whether r asks for the proxy auto-config file, which
+// browsers fetch as /proxy.pac or, with WPAD, as /wpad.dat.
+func isPACRequest(r *http.Request) bool {
+	return (r.Method == http.MethodGet || r.Method == http.MethodHead) && !r.URL.IsAbs() &&
+		(r.URL.Path == "/proxy.pac" || r.URL.Path == "/wpad.dat")
+}
+
+// servePAC answers with a FindProxyForURL built from --proxyRule. Hosts this
+// proxy reaches directly are reached directly by the clients as well, all
+// the others go through this proxy, at --pacProxy or else the address and
+// protocol the client fetched the file with.
+func servePAC(w http.ResponseWriter, r *http.Request) {
+	proxyAddr := pacProxy
+	if proxyAddr == "" {
+		proxyAddr = r.Host
+		if _, _, err := net.SplitHostPort(proxyAddr); err != nil {
+			if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+				_, port, _ := net.SplitHostPort(addr.String())
+				proxyAddr = net.JoinHostPort(proxyAddr, port)
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Cache-Control", "max-age=300")
+	w.Write([]byte(generatePAC(ternaryOp(r.TLS == nil, "PROXY ", "HTTPS ") + proxyAddr)))
+}
+
+func generatePAC(proxy string) string {
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("\tvar isIPv4 = /^\\d+\\.\\d+\\.\\d+\\.\\d+$/.test(host);\n")
+	b.WriteString("\tif (host == \"localhost\" || (isIPv4 && isInNet(host, \"127.0.0.0\", \"255.0.0.0\")))\n\t\treturn \"DIRECT\";\n")
+	for _, rule := range upstreamRules {
+		cond := pacCondition(rule.pattern)
+		if cond == "" {
+			fmt.Fprintf(&b, "\t// %s cannot be expressed in PAC\n", rule.pattern.raw)
+			continue
+		}
+		fmt.Fprintf(&b, "\tif (%s)\n\t\treturn %s;\n", cond, strconv.Quote(ternaryOp(rule.route == routeDirect, "DIRECT", proxy)))
+	}
+	fmt.Fprintf(&b, "\treturn %s;\n}\n", strconv.Quote(proxy))
+	return b.String()
+}
+
+// pacCondition translates p to JavaScript. Like p.match it never resolves
+// names, isInNet is only used on hosts given as IPv4 addresses.
+func pacCondition(p hostPattern) string {
+	switch {
+	case p.any:
+		return "true"
+	case p.prefix.IsValid():
+		if !p.prefix.Addr().Is4() {
+			return ""
+		}
+		mask := net.CIDRMask(p.prefix.Bits(), 32)
+		return fmt.Sprintf("isIPv4 && isInNet(host, %q, %q)", p.prefix.Addr(), net.IP(mask).String())
+	case p.name != "" && p.suffix != "":
+		return fmt.Sprintf("host == %q || dnsDomainIs(host, %q)", p.name, p.suffix)
+	case p.suffix != "":
+		return fmt.Sprintf("dnsDomainIs(host, %q)", p.suffix)
+	case p.name != "":
+		return fmt.Sprintf("host == %q", p.name)
+	}
+	return ""
+}
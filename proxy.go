@@ -10,48 +10,131 @@ func onError(ctx *httpproxy.Context, where string,
 	err *httpproxy.Error, opErr error) {
 	// Log errors.
 	logStderr.Printf("ERR: %s: %s [%s]\n", where, err, opErr)
+	proxyUpstreamErrors.WithLabelValues(where).Inc()
 }
 
 func onAccept(ctx *httpproxy.Context, w http.ResponseWriter,
 	r *http.Request) bool {
+	if session, ok := r.Context().Value(proxySessionKey{}).(*proxySession); ok {
+		// decrypted request of an intercepted CONNECT, already authenticated
+		ctx.UserData = &proxySession{user: session.user}
+		setAccessLogUser(r, session.user)
+		return false
+	}
+	if !isClientAllowed(r.RemoteAddr) {
+		logStderr.Printf("WARN: Proxy: client %s is not allowed\n", r.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return true
+	}
 	// Handle local request has path "/info"
 	if r.Method == "GET" && !r.URL.IsAbs() && r.URL.Path == "/info" {
 		w.Write([]byte("This is go-httpproxy."))
 		return true
 	}
-	return false
-}
+	if isPACRequest(r) {
+		servePAC(w, r)
+		return true
+	}
+	if r.Method != http.MethodConnect && !r.URL.IsAbs() {
+		return false
+	}
+	// Authenticate here rather than in OnAuth, httpproxy sends no realm with
+	// its 407 which some clients refuse to prompt for.
+	user, err := authenticateProxyRequest(r)
+	if err != nil {
+		logStderr.Printf("WARN: Proxy: %s: %v\n", r.RemoteAddr, err)
+		writeProxyAuthRequired(w)
+		return true
+	}
+	session := &proxySession{user: user}
+	ctx.UserData = session
+	setAccessLogUser(r, user)
 
-func onAuth(ctx *httpproxy.Context, authType string, user string, pass string) bool {
-	// not supported yet
-	return true
+	if reason := checkHost(r.Context(), r.URL.Host); reason != "" {
+		logStderr.Printf("WARN: Proxy: denied %s %s %s %s: %s\n", r.RemoteAddr, proxyUser(ctx), r.Method, r.URL.Host, reason)
+		writeBlockPage(w, r, user, reason)
+		return true
+	}
+
+	switch connectActionFor(r.URL.Host) {
+	case connectBlock:
+		logStdout.Printf("INFO: Proxy: %s blocked %s %s\n", proxyUser(ctx), r.Method, r.URL.Host)
+		http.Error(w, "blocked by proxy policy", http.StatusForbidden)
+		return true
+	case connectMitm:
+		if r.Method == http.MethodConnect {
+			serveMitm(ctx.Prx, w, r, session)
+			return true
+		}
+	}
+	// httpproxy can only dial tunnels directly, ours may go upstream
+	if r.Method == http.MethodConnect {
+		logStdout.Printf("INFO: Proxy: %s CONNECT %s\n", proxyUser(ctx), r.URL.Host)
+		serveTunnel(w, r)
+		return true
+	}
+	return false
 }
 
-func onConnect(ctx *httpproxy.Context, host string) (ConnectAction httpproxy.ConnectAction, newHost string) {
-	// Apply "Man in the Middle" to all ssl connections. Never change host.
-	return httpproxy.ConnectMitm, host
+func proxyUser(ctx *httpproxy.Context) string {
+	if session, ok := ctx.UserData.(*proxySession); ok && session.user != "" {
+		return session.user
+	}
+	return "-"
 }
 
 func onRequest(ctx *httpproxy.Context, req *http.Request) (
 	resp *http.Response) {
 	// Log proxying requests.
-	logStdout.Printf("INFO: Proxy: %s %s\n", req.Method, req.URL.String())
+	logStdout.Printf("INFO: Proxy: %s %s %s\n", proxyUser(ctx), req.Method, req.URL.String())
+	if session, ok := ctx.UserData.(*proxySession); ok && shouldRecordHAR(req) {
+		session.har = startHAREntry(req, session.user)
+	}
+	if rewriteRulesPath != "" {
+		resp = rewriteRequest(ctx, req)
+	}
+	if session, ok := ctx.UserData.(*proxySession); ok && resp == nil && proxyCache != nil {
+		resp = proxyCache.lookup(req, session)
+	}
+	if resp != nil {
+		// answered locally, onResponse is not called
+		finishResponse(ctx, req, resp)
+	}
 	return
 }
 
 func onResponse(ctx *httpproxy.Context, req *http.Request, resp *http.Response) {
+	if session, ok := ctx.UserData.(*proxySession); ok && session.cache != nil {
+		proxyCache.update(ctx.Prx, req, resp, session.cache)
+		session.cache = nil
+	}
+	finishResponse(ctx, req, resp)
+}
+
+// finishResponse applies what every response goes through, whether it came
+// from upstream or was made up by the proxy.
+func finishResponse(ctx *httpproxy.Context, req *http.Request, resp *http.Response) {
+	if rewriteRulesPath != "" {
+		rewriteResponse(req, resp)
+	}
+	if session, ok := ctx.UserData.(*proxySession); ok && session.har != nil {
+		finishHAREntry(session.har, resp)
+		session.har = nil
+	}
 	// Add header "Via: go-httpproxy".
 	resp.Header.Add("Via", "CUBE SA Transfer")
 }
 
 func createProxy() *httpproxy.Proxy {
 	prx, _ := httpproxy.NewProxy()
+	if t, ok := prx.Rt.(*http.Transport); ok {
+		t.TLSClientConfig.InsecureSkipVerify = insecureSkipVerify
+		t.Proxy = upstreamProxy
+	}
 
 	// Set handlers.
 	prx.OnError = onError
 	prx.OnAccept = onAccept
-	prx.OnAuth = onAuth
-	prx.OnConnect = onConnect
 	prx.OnRequest = onRequest
 	prx.OnResponse = onResponse
 
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const proxyAuthRealm = "transfer proxy"
+
+var (
+	access atomic.Pointer[accessState]
+	// verifiedCredentials caches successful checks as bcrypt is too slow to
+	// run for every proxied request
+	verifiedCredentials sync.Map
+)
+
+// accessState is who may use the proxy and manage the files of the server,
+// it is replaced as a whole when the configuration is reloaded.
+type accessState struct {
+	// --user
+	basicAuth string
+	// --htpasswd, nil without the file
+	users map[string]string
+	// --allowIP
+	clients []netip.Prefix
+}
+
+// proxySession is kept in httpproxy.Context.UserData, it lives as long as
+// the client connection, MITM sub-requests included.
+type proxySession struct {
+	user  string
+	har   *harEntry
+	cache *cacheState
+}
+
+// loadProxyAuth reads --user, --htpasswd and --allowIP, it has to be called
+// before server, proxy or socks5 mode starts serving.
+func loadProxyAuth() error {
+	a, err := readAccess(basicAuth, htpasswdPath, allowIPs)
+	if err != nil {
+		return err
+	}
+	access.Store(a)
+	return nil
+}
+
+func readAccess(basicAuth, htpasswdPath string, allowIPs []string) (*accessState, error) {
+	a := &accessState{basicAuth: basicAuth}
+	if htpasswdPath != "" {
+		users, err := readHtpasswd(htpasswdPath)
+		if err != nil {
+			return nil, err
+		}
+		a.users = users
+	}
+	for _, s := range allowIPs {
+		prefix, err := parsePrefix(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed IP %s: %w", s, err)
+		}
+		a.clients = append(a.clients, prefix)
+	}
+	return a, nil
+}
+
+// swapAccess makes a the access rules of the running listeners, requests
+// already authenticated are not affected.
+func swapAccess(a *accessState) {
+	access.Store(a)
+	verifiedCredentials.Range(func(key, _ any) bool {
+		verifiedCredentials.Delete(key)
+		return true
+	})
+}
+
+// parsePrefix accepts both a CIDR and a single address.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func readHtpasswd(name string) (map[string]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", name, lineNo)
+		}
+		if !isHtpasswdHash(hash) {
+			logStderr.Printf("WARN: %s:%d: unsupported password format for user %s, the user is ignored\n", name, lineNo, user)
+			continue
+		}
+		users[user] = hash
+	}
+	return users, scanner.Err()
+}
+
+func proxyAuthRequired() bool {
+	a := access.Load()
+	return a.users != nil || a.basicAuth != ""
+}
+
+// isClientAllowed reports whether remoteAddr is in --allowIP, everyone is
+// allowed when the list is empty.
+func isClientAllowed(remoteAddr string) bool {
+	allowedClients := access.Load().clients
+	return len(allowedClients) == 0 || containsAddr(allowedClients, remoteAddr)
+}
+
+// checkProxyCredential verifies user and pass against --htpasswd, or against
+// --user when no htpasswd file is given.
+func checkProxyCredential(user, pass string) bool {
+	a := access.Load()
+	if a.users == nil {
+		expectedUser, expectedPass, _ := strings.Cut(a.basicAuth, ":")
+		userMatch := subtle.ConstantTimeCompare([]byte(user), []byte(expectedUser)) == 1
+		passMatch := subtle.ConstantTimeCompare([]byte(pass), []byte(expectedPass)) == 1
+		return userMatch && passMatch
+	}
+	hash, ok := a.users[user]
+	if !ok {
+		return false
+	}
+	sum := sha256.Sum256([]byte(user + ":" + pass))
+	cacheKey := hex.EncodeToString(sum[:])
+	if _, ok := verifiedCredentials.Load(cacheKey); ok {
+		return true
+	}
+	if !verifyHtpasswdHash(hash, pass) {
+		return false
+	}
+	verifiedCredentials.Store(cacheKey, struct{}{})
+	return true
+}
+
+// htpasswdPlainPrefix marks a plain text password, htpasswd -p writes them
+// without one but then any unknown hash would be a valid password.
+const htpasswdPlainPrefix = "{PLAIN}"
+
+// isHtpasswdHash tells the formats verifyHtpasswdHash understands.
+func isHtpasswdHash(hash string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$", "{SHA}", "$apr1$", htpasswdPlainPrefix} {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyHtpasswdHash supports the bcrypt, SHA1 and Apache MD5 formats written
+// by htpasswd and {PLAIN} plain text passwords, it rejects anything else.
+func verifyHtpasswdHash(hash, pass string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(pass))
+		expected := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt, _, ok := strings.Cut(strings.TrimPrefix(hash, "$apr1$"), "$")
+		if !ok {
+			return false
+		}
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(apr1(pass, salt))) == 1
+	case strings.HasPrefix(hash, htpasswdPlainPrefix):
+		return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(hash, htpasswdPlainPrefix)), []byte(pass)) == 1
+	}
+	return false
+}
+
+// apr1 is the MD5 based crypt of Apache, see apr_md5.c.
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.Sum([]byte(password + salt + password))
+	h := md5.New()
+	h.Write([]byte(password + magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		h.Write(alt[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	final := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write(pw)
+		} else {
+			h.Write(final)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+		if i&1 != 0 {
+			h.Write(final)
+		} else {
+			h.Write(pw)
+		}
+		final = h.Sum(nil)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(magic + salt + "$")
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			sb.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint32(final[g[0]])<<16|uint32(final[g[1]])<<8|uint32(final[g[2]]), 4)
+	}
+	to64(uint32(final[11]), 2)
+	return sb.String()
+}
+
+// authenticateProxyRequest checks the Proxy-Authorization header of r and
+// returns the user name. Without configured credentials everybody is
+// accepted as anonymous.
+func authenticateProxyRequest(r *http.Request) (string, error) {
+	if !proxyAuthRequired() {
+		return "", nil
+	}
+	authType, data, ok := strings.Cut(r.Header.Get("Proxy-Authorization"), " ")
+	if !ok || !strings.EqualFold(authType, "Basic") {
+		return "", errors.New("missing proxy credentials")
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(data))
+	if err != nil {
+		return "", errors.New("malformed proxy credentials")
+	}
+	user, pass, ok := strings.Cut(string(raw), ":")
+	if !ok || !checkProxyCredential(user, pass) {
+		return "", fmt.Errorf("invalid proxy credentials for user %q", user)
+	}
+	return user, nil
+}
+
+func writeProxyAuthRequired(w http.ResponseWriter) {
+	w.Header().Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", proxyAuthRealm))
+	http.Error(w, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Signature starts a PROXY protocol v2 header, v1 headers start with
+// "PROXY ".
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errProxyHeader = errors.New("invalid PROXY protocol header")
+
+// listenTCP listens on addr, with --proxyProtocol the connections of
+// --trustedProxy peers report the client of their PROXY protocol header as
+// their remote address.
+func listenTCP(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil || !acceptProxyProto {
+		return ln, err
+	}
+	pl := &proxyProtoListener{
+		Listener: ln,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+	go pl.acceptLoop()
+	return pl, nil
+}
+
+// proxyProtoListener reads the PROXY protocol headers in a goroutine per
+// connection, a peer that is slow to send it does not hold up the others.
+type proxyProtoListener struct {
+	net.Listener
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *proxyProtoListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.errs <- err
+			return
+		}
+		go func() {
+			pc, err := readProxyHeader(conn)
+			if err != nil {
+				logStderr.Printf("WARN: %s: %v\n", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			select {
+			case l.conns <- pc:
+			case <-l.done:
+				pc.Close()
+			}
+		}()
+	}
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		// keep failing like a closed net.Listener
+		l.errs <- err
+		return nil, err
+	}
+}
+
+func (l *proxyProtoListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
+
+// proxiedConn is a connection whose client was told by a PROXY protocol
+// header.
+type proxiedConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxiedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// CloseWrite lets splice half-close the wrapped connection.
+func (c *proxiedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// readProxyHeader consumes the PROXY protocol v1 or v2 header a trusted proxy
+// starts conn with. Connections without one, and those of other peers, are
+// left as they are.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	if !isTrustedProxy(conn.RemoteAddr().String()) {
+		return conn, nil
+	}
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	br := bufio.NewReader(conn)
+	pc := &proxiedConn{Conn: conn, r: br, remote: conn.RemoteAddr()}
+	// look no further than the first byte could lead, a SOCKS5 greeting
+	// is shorter than the v2 signature
+	first, err := br.Peek(1)
+	switch {
+	case err != nil:
+		return pc, nil
+	case first[0] == 'P':
+		if start, _ := br.Peek(6); string(start) == "PROXY " {
+			return pc, readProxyV1(br, pc)
+		}
+	case first[0] == '\r':
+		if start, _ := br.Peek(len(proxyV2Signature)); bytes.Equal(start, proxyV2Signature) {
+			return pc, readProxyV2(br, pc)
+		}
+	}
+	return pc, nil
+}
+
+func readProxyV1(br *bufio.Reader, pc *proxiedConn) error {
+	// the longest v1 header is 107 bytes
+	line, err := br.ReadSlice('\n')
+	if err != nil || len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return errProxyHeader
+	}
+	// PROXY TCP4 192.0.2.1 192.0.2.2 56324 443
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return errProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil {
+		return errProxyHeader
+	}
+	pc.remote = &net.TCPAddr{IP: ip, Port: port}
+	return nil
+}
+
+func readProxyV2(br *bufio.Reader, pc *proxiedConn) error {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return errProxyHeader
+	}
+	verCmd, family := header[12], header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(br, body); err != nil || verCmd>>4 != 2 {
+		return errProxyHeader
+	}
+	if verCmd&0xf == 0 {
+		// LOCAL, health checks of the proxy itself
+		return nil
+	}
+	switch family >> 4 {
+	case 1:
+		if len(body) < 12 {
+			return errProxyHeader
+		}
+		pc.remote = &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}
+	case 2:
+		if len(body) < 36 {
+			return errProxyHeader
+		}
+		pc.remote = &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}
+	}
+	return nil
+}
+
+// writeProxyHeader sends the --relayProxyProtocol header announcing a
+// connection from src to dst.
+func writeProxyHeader(w io.Writer, src, dst net.Addr) error {
+	s, d := tcpAddrOf(src), tcpAddrOf(dst)
+	if relayProxyProto == "v1" {
+		if s == nil || d == nil {
+			_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+			return err
+		}
+		family := ternaryOp(s.IP.To4() != nil && d.IP.To4() != nil, "TCP4", "TCP6")
+		sIP, dIP := s.IP.String(), d.IP.String()
+		if family == "TCP6" {
+			sIP, dIP = s.IP.To16().String(), d.IP.To16().String()
+			if s.IP.To4() != nil {
+				sIP = "::ffff:" + sIP
+			}
+			if d.IP.To4() != nil {
+				dIP = "::ffff:" + dIP
+			}
+		}
+		_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", family, sIP, dIP, s.Port, d.Port)
+		return err
+	}
+
+	header := append([]byte{}, proxyV2Signature...)
+	var body []byte
+	switch {
+	case s == nil || d == nil:
+		header = append(header, 0x20, 0x00)
+	case s.IP.To4() != nil && d.IP.To4() != nil:
+		header = append(header, 0x21, 0x11)
+		body = append(append(body, s.IP.To4()...), d.IP.To4()...)
+	default:
+		header = append(header, 0x21, 0x21)
+		body = append(append(body, s.IP.To16()...), d.IP.To16()...)
+	}
+	if len(body) > 0 {
+		body = binary.BigEndian.AppendUint16(body, uint16(s.Port))
+		body = binary.BigEndian.AppendUint16(body, uint16(d.Port))
+	}
+	header = binary.BigEndian.AppendUint16(header, uint16(len(body)))
+	_, err := w.Write(append(header, body...))
+	return err
+}
+
+// tcpAddrOf returns the address of TCP and QUIC connections, nil for anything
+// else.
+func tcpAddrOf(a net.Addr) *net.TCPAddr {
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		return a
+	case *net.UDPAddr:
+		return &net.TCPAddr{IP: a.IP, Port: a.Port}
+	}
+	return nil
+}
+
+// proxyHeaderTransport sends a PROXY protocol header ahead of every relayed
+// request. The header describes a single client, so each request gets a
+// connection of its own instead of one from a shared pool.
+type proxyHeaderTransport struct{}
+
+func (proxyHeaderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var src net.Addr
+	if addr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr); err == nil {
+		src = addr
+	}
+	dst, _ := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if err = writeProxyHeader(conn, src, dst); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	if req.URL.Scheme == h2cScheme && req.Header.Get("Upgrade") == "" {
+		req = req.Clone(req.Context())
+		req.URL.Scheme = "http"
+		h2 := &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			},
+		}
+		resp, err := h2.RoundTrip(req)
+		if err != nil {
+			h2.CloseIdleConnections()
+			return nil, err
+		}
+		resp.Body = &closeIdleBody{ReadCloser: resp.Body, t: h2}
+		return resp, nil
+	}
+	if req.URL.Scheme == h2cScheme {
+		// HTTP/2 has no Upgrade, h2c servers still accept it over HTTP/1.1
+		req = req.Clone(req.Context())
+		req.URL.Scheme = "http"
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = dial
+	t.DisableKeepAlives = true
+	return t.RoundTrip(req)
+}
+
+// closeIdleBody closes the connection of a one-off HTTP/2 transport once the
+// response is read.
+type closeIdleBody struct {
+	io.ReadCloser
+	t *http2.Transport
+}
+
+func (b *closeIdleBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.t.CloseIdleConnections()
+	return err
+}
@@ -1,26 +1,326 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/http2"
+)
+
+type reverseProxyServeHandler func(addr string, handler http.Handler) error
+
+// h2cScheme marks relay targets talking HTTP/2 without TLS, like most gRPC
+// servers, for example 8080<->h2c://172.16.0.1:50051.
+const h2cScheme = "h2c"
+
+// relayTransport sends relayed requests and health probes to the targets.
+var relayTransport http.RoundTripper = backendTransport{
+	http1: http.DefaultTransport,
+	h2c: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	},
+}
+
+// backendTransport talks HTTP/2 with prior knowledge to h2c:// targets, so
+// that gRPC and its trailers make it through, and uses http1 for the rest.
+// https:// targets negotiate HTTP/2 on their own.
+type backendTransport struct {
+	http1 http.RoundTripper
+	h2c   http.RoundTripper
+}
+
+func (t backendTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != h2cScheme {
+		return t.http1.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.URL.Scheme = "http"
+	if req.Header.Get("Upgrade") != "" {
+		// HTTP/2 has no Upgrade, h2c servers still accept it over HTTP/1.1
+		return t.http1.RoundTrip(req)
+	}
+	return t.h2c.RoundTrip(req)
+}
+
+// targetTransport is relayTransport, or with --relayProxyProtocol the
+// transport sending PROXY protocol headers, health probes included.
+func targetTransport() http.RoundTripper {
+	if relayProxyProto != "" {
+		return proxyHeaderTransport{}
+	}
+	return relayTransport
+}
+
+// createReverseProxy relays to the backends of b. httputil.ReverseProxy
+// already takes care of WebSocket upgrades, trailers and of flushing streamed
+// responses like server-sent events right away.
+func createReverseProxy(b *balancer) http.Handler {
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			be := b.pick()
+			pr.Out = withPickedBackend(pr.Out, be)
+			if be == nil {
+				// balancerTransport fails the request
+				return
+			}
+			pr.SetURL(be.target)
+			// keep the Host the client sent, like NewSingleHostReverseProxy
+			pr.Out.Host = pr.In.Host
+			setForwardedHeaders(pr)
+		},
+		Transport: balancerTransport{instrumentedTransport{targetTransport()}},
+		ErrorLog:  logStderr,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if errors.Is(err, errNoBackend) {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			if !errors.Is(err, context.Canceled) {
+				logStderr.Println("ERR: Relay:", err)
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+}
+
+// relayPort is a port relay mode listens on. A reload swaps what it relays
+// to while the listener keeps running.
+type relayPort struct {
+	port string
+	// tcp or udp for plain port forwarding, empty for HTTP
+	forward string
+	// HTTP ports route requests, tcp:// and udp:// ports have a balancer
+	router   *relayRouter
+	balancer atomic.Pointer[balancer]
+	// ctx of the listener and the end of the current health checks
+	ctx        context.Context
+	stopChecks context.CancelFunc
+}
+
+var (
+	relayPortsMu sync.Mutex
+	relayPorts   = make(map[string]*relayPort)
 )
 
-type reverseProxyServeHandler func(*http.ServeMux) error
+// relayPlan is what a relay listener relays to, the routes of each HTTP port
+// and the balancer of each tcp:// and udp:// port.
+type relayPlan struct {
+	ports     []string
+	routes    map[string][]*relayRoute
+	forwarded map[string]*balancer
+}
 
-func createReverseProxy(h reverseProxyServeHandler, target string, wg *sync.WaitGroup) {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		u, err := url.Parse(target)
+// planRelays reads the routes file and the port mappings args. HTTP mappings
+// become the last route of their port, so they catch what the routes of the
+// file leave.
+func planRelays(args []string, routesPath string) (*relayPlan, error) {
+	plan := &relayPlan{
+		routes:    make(map[string][]*relayRoute),
+		forwarded: make(map[string]*balancer),
+	}
+	var routes []*relayRoute
+	if routesPath != "" {
+		var err error
+		if routes, err = readRelayRoutes(routesPath); err != nil {
+			return nil, err
+		}
+	}
+	addRoute := func(route *relayRoute) {
+		if plan.routes[route.Port] == nil {
+			plan.ports = append(plan.ports, route.Port)
+		}
+		plan.routes[route.Port] = append(plan.routes[route.Port], route)
+	}
+	for _, route := range routes {
+		addRoute(route)
+	}
+	for _, a := range args {
+		ss := strings.Split(a, "<->")
+		if len(ss) != 2 {
+			logStdout.Println("Drop invalid port mapping entry", a)
+			continue
+		}
+		b, err := newBalancer(ss[1], relayStrategy)
 		if err != nil {
-			logStderr.Println(target, err)
-			return
+			logStdout.Println("Drop invalid port mapping entry", a, err)
+			continue
+		}
+		if b.forward == "" {
+			addRoute(&relayRoute{Port: ss[0], Targets: ss[1], balancer: b, proxy: createReverseProxy(b)})
+			continue
 		}
+		if _, ok := plan.forwarded[ss[0]]; ok || plan.routes[ss[0]] != nil {
+			logStdout.Println("Drop port mapping entry", a, "as the port is already in use")
+			continue
+		}
+		plan.forwarded[ss[0]] = b
+		plan.ports = append(plan.ports, ss[0])
+	}
+	return plan, nil
+}
+
+// serveRelays starts the relays of the routes file and of the port mappings
+// args. It returns the first serving error, or once all of them have been
+// shut down after ctx is cancelled.
+func serveRelays(ctx context.Context, args []string, routesPath string, h reverseProxyServeHandler) error {
+	if len(args) == 0 && routesPath == "" {
+		return errors.New("Port mapping is missing.")
+	}
+	plan, err := planRelays(args, routesPath)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		logStdout.Println("Starting http reverse proxy at", strings.Join(args, " "), ", please don't close it if you are not sure what it is doing.")
+	}
+
+	var ports []*relayPort
+	relayPortsMu.Lock()
+	for _, port := range plan.ports {
+		if relayPorts[port] != nil {
+			relayPortsMu.Unlock()
+			return fmt.Errorf("relay port %s is mapped by two listeners", port)
+		}
+		rp := &relayPort{port: port, ctx: ctx}
+		if b := plan.forwarded[port]; b != nil {
+			rp.forward = b.forward
+		} else {
+			rp.router = &relayRouter{port: port}
+		}
+		rp.use(plan.routes[port], plan.forwarded[port])
+		relayPorts[port] = rp
+		ports = append(ports, rp)
+	}
+	relayPortsMu.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(ports))
+	for _, rp := range ports {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			switch rp.forward {
+			case forwardTCP:
+				errs <- serveTCPForward(ctx, rp)
+			case forwardUDP:
+				errs <- serveUDPForward(ctx, rp)
+			default:
+				errs <- h(fmt.Sprintf(":%s", rp.port), instrument("relay", withCompression(rp.router)))
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(errs)
+	}()
+
+	var result error
+	for err := range errs {
+		if err == nil {
+			continue
+		}
+		if ctx.Err() == nil {
+			return err
+		}
+		result = err
+	}
+	return result
+}
 
-		proxy := httputil.NewSingleHostReverseProxy(u)
-		proxy.ServeHTTP(w, r)
-	})
-	logStderr.Fatal(h(mux))
-	wg.Done()
+// use makes the port relay to routes, or to b for tcp:// and udp://, from now
+// on. Requests and connections in flight finish with what they started with.
+// relayPortsMu must be held.
+func (rp *relayPort) use(routes []*relayRoute, b *balancer) {
+	if rp.stopChecks != nil {
+		rp.stopChecks()
+	}
+	ctx, cancel := context.WithCancel(rp.ctx)
+	rp.stopChecks = cancel
+	unregisterRelayMappings(rp.port)
+	if b != nil {
+		registerRelayMapping(ctx, rp.port, b.forward+"://", b)
+		rp.balancer.Store(b)
+		return
+	}
+	for _, route := range routes {
+		logStdout.Printf("INFO: Relay: :%s %s <-> %s\n", route.Port, route, route.Targets)
+		registerRelayMapping(ctx, route.Port, route.String(), route.balancer)
+	}
+	rp.router.setRoutes(routes)
+}
+
+// swapRelays makes the running relay ports relay to what plans say. Ports
+// are only opened and closed by a restart.
+func swapRelays(plans []*relayPlan) {
+	relayPortsMu.Lock()
+	defer relayPortsMu.Unlock()
+	planned := make(map[string]bool)
+	for _, plan := range plans {
+		for _, port := range plan.ports {
+			planned[port] = true
+			rp, b := relayPorts[port], plan.forwarded[port]
+			forward := ""
+			if b != nil {
+				forward = b.forward
+			}
+			switch {
+			case rp == nil:
+				logStderr.Printf("WARN: Relay: :%s is new, restart to listen on it\n", port)
+			case rp.forward != forward:
+				logStderr.Printf("WARN: Relay: :%s switches between HTTP, tcp:// and udp://, restart to apply\n", port)
+			default:
+				rp.use(plan.routes[port], b)
+			}
+		}
+	}
+	for port := range relayPorts {
+		if !planned[port] {
+			logStderr.Printf("WARN: Relay: :%s is no longer mapped, restart to close it\n", port)
+		}
+	}
+}
+
+// registerRelayMapping lists b on the status page and starts its health
+// checks, it has to be called before b takes requests.
+func registerRelayMapping(ctx context.Context, port, route string, b *balancer) {
+	b.port, b.route = port, route
+	relayMappingsMu.Lock()
+	relayMappings = append(relayMappings, relayMapping{Port: port, Route: route, balancer: b})
+	relayMappingsMu.Unlock()
+	for _, be := range b.backends {
+		relayBackendUp.WithLabelValues(port, route, be.target.Host).Set(1)
+	}
+	if relayHealthPath != "" && b.forward != forwardUDP {
+		go probeBackends(ctx, b)
+	}
+}
+
+// unregisterRelayMappings takes the balancers of port off the status page
+// and the metrics.
+func unregisterRelayMappings(port string) {
+	relayMappingsMu.Lock()
+	defer relayMappingsMu.Unlock()
+	kept := relayMappings[:0]
+	for _, m := range relayMappings {
+		if m.Port != port {
+			kept = append(kept, m)
+			continue
+		}
+		for _, be := range m.balancer.backends {
+			relayBackendUp.DeleteLabelValues(m.Port, m.Route, be.target.Host)
+		}
+	}
+	relayMappings = kept
 }
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// testBackend answers like a gRPC service on /grpc, streams server-sent
+// events on /sse and echoes WebSocket frames on /ws. It talks h2c and
+// HTTP/1.1 on the same port, like the gRPC servers relay mode targets.
+type testBackend struct {
+	// release lets /sse send its second event
+	release chan struct{}
+}
+
+func (b *testBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/grpc":
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.Header().Set("X-Backend-Proto", r.Proto)
+		w.Write(body)
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "done")
+	case "/sse":
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		select {
+		case <-b.release:
+		case <-r.Context().Done():
+			return
+		}
+		fmt.Fprint(w, "data: second\n\n")
+	case "/ws":
+		if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			http.Error(w, "expected a WebSocket upgrade", http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func startTestBackend(t *testing.T) (*httptest.Server, *testBackend) {
+	t.Helper()
+	b := &testBackend{release: make(chan struct{})}
+	srv := httptest.NewServer(h2c.NewHandler(b, &http2.Server{}))
+	t.Cleanup(srv.Close)
+	return srv, b
+}
+
+// startTestRelay serves createReverseProxy for target over TLS with HTTP/2
+// and, on the same port number, over HTTP/3.
+func startTestRelay(t *testing.T, target string) (front *httptest.Server, h3URL string) {
+	t.Helper()
+	b, err := newBalancer(target, balanceRoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := createReverseProxy(b)
+	front = httptest.NewUnstartedServer(proxy)
+	front.EnableHTTP2 = true
+	front.StartTLS()
+	t.Cleanup(front.Close)
+	return front, startTestHTTP3(t, proxy, front.TLS.Certificates)
+}
+
+func startTestHTTP3(t *testing.T, h http.Handler, certs []tls.Certificate) string {
+	t.Helper()
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &http3.Server{Handler: h, TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: certs})}
+	go s.Serve(udpConn)
+	t.Cleanup(func() {
+		s.Close()
+		udpConn.Close()
+	})
+	return "https://" + udpConn.LocalAddr().String()
+}
+
+func newTestHTTP3Client(t *testing.T) *http.Client {
+	rt := &http3.RoundTripper{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	t.Cleanup(func() { rt.Close() })
+	return &http.Client{Transport: rt, Timeout: 10 * time.Second}
+}
+
+func checkGRPC(t *testing.T, client *http.Client, base string, proto int) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, base+"/grpc", strings.NewReader("hello"))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ProtoMajor != proto {
+		t.Errorf("relay answered with %s, want HTTP/%d", resp.Proto, proto)
+	}
+	if string(body) != "hello" {
+		t.Errorf("body = %q, want %q", body, "hello")
+	}
+	if got := resp.Header.Get("X-Backend-Proto"); got != "HTTP/2.0" {
+		t.Errorf("backend was reached with %s, want HTTP/2.0", got)
+	}
+	if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+		t.Errorf("Grpc-Status trailer = %q, want 0", got)
+	}
+	if got := resp.Trailer.Get("Grpc-Message"); got != "done" {
+		t.Errorf("Grpc-Message trailer = %q, want done", got)
+	}
+}
+
+// checkSSE reads the first event while the backend still holds back the
+// second one, which only works when the relay flushes.
+func checkSSE(t *testing.T, client *http.Client, base string, backend *testBackend) {
+	t.Helper()
+	resp, err := client.Get(base + "/sse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	br := bufio.NewReader(resp.Body)
+	first := make(chan string, 1)
+	go func() {
+		line, _ := br.ReadString('\n')
+		first <- line
+	}()
+	select {
+	case line := <-first:
+		if line != "data: first\n" {
+			t.Fatalf("first event = %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the first event was not flushed")
+	}
+	backend.release <- struct{}{}
+	rest, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "\ndata: second\n\n" {
+		t.Errorf("rest of the stream = %q", rest)
+	}
+}
+
+func TestRelayGRPCTrailers(t *testing.T) {
+	backend, _ := startTestBackend(t)
+	front, h3URL := startTestRelay(t, "h2c://"+backend.Listener.Addr().String())
+	t.Run("HTTP/2", func(t *testing.T) {
+		checkGRPC(t, front.Client(), front.URL, 2)
+	})
+	t.Run("HTTP/3", func(t *testing.T) {
+		checkGRPC(t, newTestHTTP3Client(t), h3URL, 3)
+	})
+}
+
+func TestRelayServerSentEvents(t *testing.T) {
+	backend, b := startTestBackend(t)
+	front, h3URL := startTestRelay(t, backend.URL)
+	t.Run("HTTP/2", func(t *testing.T) {
+		checkSSE(t, front.Client(), front.URL, b)
+	})
+	t.Run("HTTP/3", func(t *testing.T) {
+		checkSSE(t, newTestHTTP3Client(t), h3URL, b)
+	})
+}
+
+func TestRelayWebSocket(t *testing.T) {
+	backend, _ := startTestBackend(t)
+	// h2c:// targets get upgrades over HTTP/1.1
+	for _, target := range []string{backend.URL, "h2c://" + backend.Listener.Addr().String()} {
+		t.Run(target, func(t *testing.T) {
+			front, _ := startTestRelay(t, target)
+			conn, err := tls.Dial("tcp", front.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			fmt.Fprint(conn, "GET /ws HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+				"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("status = %s, want 101", resp.Status)
+			}
+			fmt.Fprint(conn, "ping")
+			echo := make([]byte, 4)
+			if _, err = io.ReadFull(br, echo); err != nil {
+				t.Fatal(err)
+			}
+			if string(echo) != "ping" {
+				t.Errorf("echo = %q, want ping", echo)
+			}
+		})
+	}
+}
+
+func TestRelayRouterStripPrefix(t *testing.T) {
+	var got string
+	route := &relayRoute{Path: "/v1/", StripPrefix: true, proxy: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.EscapedPath()
+	})}
+	rt := &relayRouter{routes: []*relayRoute{route}}
+	for uri, want := range map[string]string{
+		"/v1/a%2Fb/c": "/a%2Fb/c",
+		"/v1/a/b":     "/a/b",
+		"/v1/":        "/",
+	} {
+		got = ""
+		rt.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, uri, nil))
+		if got != want {
+			t.Errorf("%s reached the route as %q, want %q", uri, got, want)
+		}
+	}
+}
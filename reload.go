@@ -0,0 +1,192 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadMu serializes reloads, a file change and SIGHUP may come together.
+var reloadMu sync.Mutex
+
+// watchConfig reloads the running listeners when --config, --htpasswd or a
+// relay routes file changes, and on SIGHUP.
+func watchConfig() {
+	var paths []string
+	if configPath != "" {
+		paths = append(paths, configPath)
+	}
+	if htpasswdPath != "" {
+		paths = append(paths, htpasswdPath)
+	}
+	for _, l := range listeners {
+		if l.Routes != "" {
+			paths = append(paths, l.Routes)
+		}
+	}
+	if len(paths) > 0 {
+		watchFile("configuration", reloadConfig, paths...)
+	}
+}
+
+// reloadConfig reads the users, the allowed clients, --relayMaxConns and the
+// relay routes and backends again. They are swapped in together once all of
+// them were read without error, requests in flight finish with the old ones.
+// Other settings, listeners and relay ports only change with a restart.
+func reloadConfig() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	user, htpasswd, allowed, maxConns := basicAuth, htpasswdPath, allowIPs, relayMaxConns
+	running := listeners
+	if configPath != "" {
+		cfg, err := readConfig(configPath)
+		if err != nil {
+			return err
+		}
+		// settings dropped from the file are back to their defaults
+		if !commandLineFlags["user"] {
+			user = ""
+		}
+		if !commandLineFlags["htpasswd"] {
+			htpasswd = ""
+		}
+		if !commandLineFlags["allowIP"] {
+			allowed = nil
+		}
+		if !commandLineFlags["relayMaxConns"] {
+			maxConns = 0
+		}
+		for _, setting := range cfg.settings {
+			if commandLineFlags[setting.name] {
+				continue
+			}
+			switch setting.name {
+			case "user":
+				user = setting.values[0]
+			case "htpasswd":
+				htpasswd = setting.values[0]
+			case "allowIP":
+				allowed = nil
+				for _, v := range setting.values {
+					allowed = append(allowed, strings.Split(v, ",")...)
+				}
+			case "relayMaxConns":
+				if maxConns, err = strconv.Atoi(setting.values[0]); err != nil {
+					return configError(configPath, setting.node, "invalid relayMaxConns %s", setting.values[0])
+				}
+			}
+		}
+		if len(cfg.listeners) > 0 {
+			warnListenerChanges(cfg.listeners)
+			running = cfg.listeners
+		}
+	}
+
+	a, err := readAccess(user, htpasswd, allowed)
+	if err != nil {
+		return err
+	}
+	var plans []*relayPlan
+	for _, l := range running {
+		if l.Mode != "relay" {
+			continue
+		}
+		plan, err := planRelays(l.Mappings, l.Routes)
+		if err != nil {
+			return err
+		}
+		plans = append(plans, plan)
+	}
+
+	swapAccess(a)
+	relayConnLimit.Store(int64(maxConns))
+	if runsMode("relay") {
+		swapRelays(plans)
+	}
+	logStdout.Println("INFO: reloaded the configuration")
+	return nil
+}
+
+// warnListenerChanges tells about the server, proxy and socks5 listeners
+// which a reload cannot start or stop.
+func warnListenerChanges(next []*listener) {
+	key := func(l *listener) string {
+		return l.Mode + " " + l.Protocol + " " + l.Listen
+	}
+	current := make(map[string]bool)
+	for _, l := range listeners {
+		current[key(l)] = true
+	}
+	for _, l := range next {
+		if l.Mode != "relay" && !current[key(l)] {
+			logStderr.Printf("WARN: %s listener %s is new, restart to start it\n", l.Mode, l.Listen)
+		}
+		delete(current, key(l))
+	}
+	for k := range current {
+		if !strings.HasPrefix(k, "relay ") {
+			logStderr.Printf("WARN: %s listener is no longer configured, restart to stop it\n", k)
+		}
+	}
+}
+
+// watchFile calls reload when one of paths is written or replaced, and on
+// SIGHUP. The directories are watched since editors and config management
+// often replace files instead of writing them in place.
+func watchFile(what string, reload func() error, paths ...string) {
+	watched := make(map[string]bool)
+	for _, path := range paths {
+		watched[filepath.Clean(path)] = true
+	}
+	go func() {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			logStderr.Println("ERR: watching", what+":", err)
+			return
+		}
+		defer watcher.Close()
+		for path := range watched {
+			if err = watcher.Add(filepath.Dir(path)); err != nil {
+				logStderr.Println("ERR: watching", what+":", err)
+				return
+			}
+		}
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if path := filepath.Clean(event.Name); watched[path] && event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+					logStdout.Printf("INFO: %s changed, reloading %s\n", path, what)
+					if err := reload(); err != nil {
+						logStderr.Printf("WARN: keeping the old %s: %v\n", what, err)
+					}
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logStderr.Println("ERR: watching", what+":", err)
+			}
+		}
+	}()
+
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGHUP)
+		for range c {
+			logStdout.Printf("INFO: received SIGHUP, reloading %s\n", what)
+			if err := reload(); err != nil {
+				logStderr.Printf("WARN: keeping the old %s: %v\n", what, err)
+			}
+		}
+	}()
+}
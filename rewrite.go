@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-httpproxy/httpproxy"
+	"gopkg.in/yaml.v3"
+)
+
+// rewriteConfig is the --rewriteRules file, for example:
+//
+//	rules:
+//	  - name: api-v2
+//	    host: api.example.com
+//	    url: ^https?://api\.example\.com/v1/(.*)$
+//	    redirect: https://api.example.com/v2/$1
+//	  - host: "*.example.com"
+//	    request:
+//	      set: {X-Team: ci}
+//	      remove: [Cookie]
+//	    response:
+//	      replace:
+//	        - {header: Cache-Control, pattern: no-cache, with: max-age=3600}
+//	  - url: ^http://mock\.local/health$
+//	    mock: {status: 200, headers: {Content-Type: application/json}, body: '{"ok":true}'}
+//
+// Every matching rule edits the headers, the first matching rule with
+// block, redirect or mock answers the request without going upstream.
+type rewriteConfig struct {
+	Rules []*rewriteRule `yaml:"rules"`
+}
+
+type rewriteRule struct {
+	Name           string        `yaml:"name"`
+	Host           string        `yaml:"host"`
+	URL            string        `yaml:"url"`
+	Methods        []string      `yaml:"methods"`
+	Request        headerEdits   `yaml:"request"`
+	Response       headerEdits   `yaml:"response"`
+	Block          bool          `yaml:"block"`
+	Redirect       string        `yaml:"redirect"`
+	RedirectStatus int           `yaml:"redirectStatus"`
+	Mock           *mockResponse `yaml:"mock"`
+
+	host hostPattern
+	url  *regexp.Regexp
+}
+
+type headerEdits struct {
+	Set     map[string]string `yaml:"set"`
+	Add     map[string]string `yaml:"add"`
+	Remove  []string          `yaml:"remove"`
+	Replace []headerReplace   `yaml:"replace"`
+}
+
+type headerReplace struct {
+	Header  string `yaml:"header"`
+	Pattern string `yaml:"pattern"`
+	With    string `yaml:"with"`
+
+	re *regexp.Regexp
+}
+
+type mockResponse struct {
+	Status  int               `yaml:"status"`
+	Headers map[string]string `yaml:"headers"`
+	Body    string            `yaml:"body"`
+	File    string            `yaml:"file"`
+
+	content []byte
+}
+
+var (
+	rewriteMu    sync.RWMutex
+	rewriteRules []*rewriteRule
+)
+
+// loadRewriteRules reads --rewriteRules and reloads it whenever the file
+// changes or SIGHUP is received, a broken file keeps the previous rules.
+func loadRewriteRules() error {
+	if err := reloadRewriteRules(); err != nil {
+		return err
+	}
+	watchFile("rewrite rules", reloadRewriteRules, rewriteRulesPath)
+	return nil
+}
+
+func reloadRewriteRules() error {
+	rules, err := readRewriteRules(rewriteRulesPath)
+	if err != nil {
+		return err
+	}
+	rewriteMu.Lock()
+	defer rewriteMu.Unlock()
+	rewriteRules = rules
+	logStdout.Printf("INFO: Proxy: loaded %d rewrite rules from %s\n", len(rules), rewriteRulesPath)
+	return nil
+}
+
+func readRewriteRules(path string) ([]*rewriteRule, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg rewriteConfig
+	if err = yaml.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i, rule := range cfg.Rules {
+		if rule.Name == "" {
+			rule.Name = "#" + strconv.Itoa(i+1)
+		}
+		if err = rule.compile(filepath.Dir(path)); err != nil {
+			return nil, fmt.Errorf("%s: rule %s: %w", path, rule.Name, err)
+		}
+	}
+	return cfg.Rules, nil
+}
+
+func (rule *rewriteRule) compile(dir string) (err error) {
+	if rule.Host != "" {
+		if rule.host, err = parseHostPattern(rule.Host); err != nil {
+			return err
+		}
+	}
+	if rule.URL != "" {
+		if rule.url, err = regexp.Compile(rule.URL); err != nil {
+			return err
+		}
+	}
+	for i, m := range rule.Methods {
+		rule.Methods[i] = strings.ToUpper(m)
+	}
+	for _, edits := range []*headerEdits{&rule.Request, &rule.Response} {
+		for i := range edits.Replace {
+			r := &edits.Replace[i]
+			if r.Header == "" {
+				return fmt.Errorf("replace needs a header")
+			}
+			if r.re, err = regexp.Compile(r.Pattern); err != nil {
+				return err
+			}
+		}
+	}
+	actions := 0
+	for _, set := range []bool{rule.Block, rule.Redirect != "", rule.Mock != nil} {
+		if set {
+			actions++
+		}
+	}
+	if actions > 1 {
+		return fmt.Errorf("only one of block, redirect and mock can be used")
+	}
+	if rule.Redirect != "" {
+		if rule.RedirectStatus == 0 {
+			rule.RedirectStatus = http.StatusFound
+		}
+		if rule.RedirectStatus < 300 || rule.RedirectStatus > 399 {
+			return fmt.Errorf("invalid redirect status %d", rule.RedirectStatus)
+		}
+	}
+	if m := rule.Mock; m != nil {
+		if m.Status == 0 {
+			m.Status = http.StatusOK
+		}
+		m.content = []byte(m.Body)
+		if m.File != "" {
+			name := m.File
+			if !filepath.IsAbs(name) {
+				name = filepath.Join(dir, name)
+			}
+			if m.content, err = os.ReadFile(name); err != nil {
+				return err
+			}
+			if _, ok := m.Headers["Content-Type"]; !ok {
+				if ct := mime.TypeByExtension(filepath.Ext(name)); ct != "" {
+					if m.Headers == nil {
+						m.Headers = make(map[string]string)
+					}
+					m.Headers["Content-Type"] = ct
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (rule *rewriteRule) match(req *http.Request) bool {
+	if rule.Host != "" && !rule.host.match(req.URL.Host) {
+		return false
+	}
+	if rule.url != nil && !rule.url.MatchString(req.URL.String()) {
+		return false
+	}
+	if len(rule.Methods) == 0 {
+		return true
+	}
+	for _, m := range rule.Methods {
+		if m == req.Method {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *headerEdits) apply(h http.Header) {
+	for _, name := range e.Remove {
+		h.Del(name)
+	}
+	for name, value := range e.Set {
+		h.Set(name, value)
+	}
+	for name, value := range e.Add {
+		h.Add(name, value)
+	}
+	for _, r := range e.Replace {
+		values := h[http.CanonicalHeaderKey(r.Header)]
+		for i, v := range values {
+			values[i] = r.re.ReplaceAllString(v, r.With)
+		}
+	}
+}
+
+func matchingRewriteRules(req *http.Request) []*rewriteRule {
+	rewriteMu.RLock()
+	defer rewriteMu.RUnlock()
+	var matched []*rewriteRule
+	for _, rule := range rewriteRules {
+		if rule.match(req) {
+			matched = append(matched, rule)
+		}
+	}
+	return matched
+}
+
+// rewriteRequest edits req with the matching rules, and returns the response
+// of the first rule answering it locally.
+func rewriteRequest(ctx *httpproxy.Context, req *http.Request) *http.Response {
+	for _, rule := range matchingRewriteRules(req) {
+		if resp := rule.respond(ctx, req); resp != nil {
+			return resp
+		}
+		rule.Request.apply(req.Header)
+	}
+	return nil
+}
+
+func (rule *rewriteRule) respond(ctx *httpproxy.Context, req *http.Request) *http.Response {
+	switch {
+	case rule.Block:
+		logStdout.Printf("INFO: Proxy: %s rule %s blocked %s %s\n", proxyUser(ctx), rule.Name, req.Method, req.URL)
+		return httpproxy.InMemoryResponse(http.StatusForbidden, nil, []byte("blocked by proxy rule "+rule.Name+"\n"))
+	case rule.Redirect != "":
+		location := rule.Redirect
+		if rule.url != nil {
+			location = rule.url.ReplaceAllString(req.URL.String(), rule.Redirect)
+		}
+		logStdout.Printf("INFO: Proxy: %s rule %s redirected %s to %s\n", proxyUser(ctx), rule.Name, req.URL, location)
+		header := make(http.Header)
+		header.Set("Location", location)
+		return httpproxy.InMemoryResponse(rule.RedirectStatus, header, nil)
+	case rule.Mock != nil:
+		header := make(http.Header)
+		for name, value := range rule.Mock.Headers {
+			header.Set(name, value)
+		}
+		resp := httpproxy.InMemoryResponse(rule.Mock.Status, header, rule.Mock.content)
+		if req.Method == http.MethodHead {
+			resp.Body = nil
+		}
+		return resp
+	}
+	return nil
+}
+
+// rewriteResponse edits the headers of resp, the answer to req, with the
+// matching rules.
+func rewriteResponse(req *http.Request, resp *http.Response) {
+	for _, rule := range matchingRewriteRules(req) {
+		rule.Response.apply(resp.Header)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// relayRouteConfig is the --relayRoutes file, for example:
+//
+//	routes:
+//	  - port: 8080
+//	    host: api.example.com
+//	    path: /v1/
+//	    stripPrefix: true
+//	    targets: http://10.0.0.1:8000,http://10.0.0.2:8000
+//	    strategy: leastconn
+//	  - port: 8080
+//	    headers: {X-Canary: "1"}
+//	    targets: http://10.0.0.3:8000
+//	  - port: 8080
+//	    targets: http://10.0.0.4:8000
+//
+// The routes of a port are tried in order, the first one matching the Host
+// header, path prefix and headers of a request gets it.
+type relayRouteConfig struct {
+	Routes []*relayRoute `yaml:"routes"`
+}
+
+type relayRoute struct {
+	Port        string            `yaml:"port"`
+	Host        string            `yaml:"host"`
+	Path        string            `yaml:"path"`
+	Headers     map[string]string `yaml:"headers"`
+	StripPrefix bool              `yaml:"stripPrefix"`
+	Targets     string            `yaml:"targets"`
+	Strategy    string            `yaml:"strategy"`
+
+	host     hostPattern
+	balancer *balancer
+	proxy    http.Handler
+}
+
+// relayRouter is the handler of a relay port, it dispatches every request
+// to the first matching route.
+type relayRouter struct {
+	port   string
+	mu     sync.RWMutex
+	routes []*relayRoute
+}
+
+func (rt *relayRouter) setRoutes(routes []*relayRoute) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.routes = routes
+}
+
+func readRelayRoutes(path string) ([]*relayRoute, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg relayRouteConfig
+	if err = yaml.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i, route := range cfg.Routes {
+		if route.Port == "" || route.Targets == "" {
+			return nil, fmt.Errorf("%s: route #%d needs a port and targets", path, i+1)
+		}
+		if err = route.compile(); err != nil {
+			return nil, fmt.Errorf("%s: route #%d: %w", path, i+1, err)
+		}
+	}
+	return cfg.Routes, nil
+}
+
+func (route *relayRoute) compile() (err error) {
+	if route.Host != "" {
+		if route.host, err = parseHostPattern(route.Host); err != nil {
+			return err
+		}
+	}
+	if route.Path != "" && !strings.HasPrefix(route.Path, "/") {
+		return fmt.Errorf("path %s does not start with /", route.Path)
+	}
+	if route.balancer, err = newBalancer(route.Targets, ternaryOp(route.Strategy != "", route.Strategy, relayStrategy)); err != nil {
+		return err
+	}
+	if route.balancer.forward != "" {
+		return fmt.Errorf("%s:// targets cannot be routed, map them to a port of their own", route.balancer.forward)
+	}
+	route.proxy = createReverseProxy(route.balancer)
+	return nil
+}
+
+// String describes what the route matches, for logs and the status page.
+func (route *relayRoute) String() string {
+	s := ternaryOp(route.Host != "", route.Host, "*") + ternaryOp(route.Path != "", route.Path, "/")
+	for name, value := range route.Headers {
+		s += fmt.Sprintf(" %s=%s", name, value)
+	}
+	return s
+}
+
+// hasPathPrefix matches whole path segments, /api matches /api and /api/x
+// but not /apix.
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+func (route *relayRoute) match(r *http.Request) bool {
+	if route.Host != "" && !route.host.match(r.Host) {
+		return false
+	}
+	if route.Path != "" && !hasPathPrefix(r.URL.Path, route.Path) {
+		return false
+	}
+	for name, value := range route.Headers {
+		if r.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (rt *relayRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.mu.RLock()
+	routes := rt.routes
+	rt.mu.RUnlock()
+	for _, route := range routes {
+		if !route.match(r) {
+			continue
+		}
+		if route.StripPrefix && route.Path != "" {
+			prefix := strings.TrimSuffix(route.Path, "/")
+			r2 := r.Clone(r.Context())
+			r2.URL.Path = strings.TrimPrefix(r.URL.Path, prefix)
+			if r2.URL.Path == "" {
+				r2.URL.Path = "/"
+			}
+			// keep escapes like %2F as http.StripPrefix does, RawPath is
+			// only dropped when the prefix is escaped differently in it
+			if rp := strings.TrimPrefix(r.URL.RawPath, prefix); len(rp) < len(r.URL.RawPath) {
+				r2.URL.RawPath = rp
+			} else {
+				r2.URL.RawPath = ""
+			}
+			r2.Header.Set("X-Forwarded-Prefix", prefix)
+			r = r2
+		}
+		route.proxy.ServeHTTP(w, r)
+		return
+	}
+	http.Error(w, "no relay route for "+r.Host+r.URL.Path, http.StatusNotFound)
+}
@@ -1,21 +1,52 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
-	"io"
 	"net"
 	"net/http"
-	"os"
-	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 	"github.com/missdeer/transfer/keypair"
 )
 
 func uploadFileHandler(w http.ResponseWriter, r *http.Request) {
+	tsBegin := time.Now()
+	defer func() {
+		uploadDuration.Observe(time.Since(tsBegin).Seconds())
+	}()
+
+	// tell clients which Content-Encoding uploads may have, RFC 7694
+	w.Header().Set("Accept-Encoding", strings.Join(uploadEncodings, ", "))
+	if encoding := r.Header.Get("Content-Encoding"); encoding != "" {
+		body, err := decodeBody(encoding, r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+		defer body.Close()
+		r.Body = body
+		r.Header.Del("Content-Encoding")
+		r.ContentLength = -1
+	}
+	if maxUploadSize > 0 {
+		// counts the decoded bytes, a small compressed body may expand a lot
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize<<20)
+	}
+
 	// upload size
 	err := r.ParseMultipartForm(200000) // grab the multipart form
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
 		fmt.Fprintln(w, err)
 	}
@@ -28,31 +59,70 @@ func uploadFileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer file.Close()
+	setAccessLogUpload(r, handler.Filename)
 
-	tempFileName := filepath.Join(fileServePath, "."+handler.Filename+"~")
-	resFile, err := os.Create(tempFileName)
-	if err != nil {
-		fmt.Fprintln(w, err)
+	if dedup {
+		hash, err := storeBlob(file, r.Header.Get(contentHashHeader))
+		if errors.Is(err, errContentHashMismatch) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			fmt.Fprintln(w, err)
+			return
+		}
+		if err = linkBlob(hash, "/"+handler.Filename); err != nil {
+			fmt.Fprintln(w, err)
+			return
+		}
+		fmt.Fprintf(w, "Successfully Uploaded Original File\n")
 		return
 	}
 
-	_, err = io.Copy(resFile, file)
-	resFile.Close()
-
-	if err != nil {
+	if err = serveStorage.Create("/"+handler.Filename, file); err != nil {
 		fmt.Fprintln(w, err)
 		return
 	}
-
-	destFileName := filepath.Join(fileServePath, handler.Filename)
-	os.Rename(tempFileName, destFileName)
 	fmt.Fprintf(w, "Successfully Uploaded Original File\n")
 }
 
-func listenAndServe(addr, certFile, keyFile string, handler http.Handler, quicOnly bool) error {
+// hiddenServePaths lists the bookkeeping directories kept inside the storage
+// which must not show up in the served tree.
+func hiddenServePaths() []string {
+	var hidden []string
+	if dedup {
+		hidden = append(hidden, blobStorePath())
+	}
+	if name, ok := trashStorageName(); ok {
+		hidden = append(hidden, name)
+	}
+	return hidden
+}
+
+func registerServerHandlers() {
+	http.HandleFunc("/uploadFile", uploadFileHandler)
+	registerFileManageHandlers(http.DefaultServeMux)
+	if dedup {
+		registerDedupHandlers(http.DefaultServeMux)
+	}
+	fsys := storageFS{st: serveStorage, hidden: hiddenServePaths()}
+	fileServer := http.FileServer(fsys)
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		tsBegin := time.Now()
+		if !servePrecompressed(w, r, fsys) {
+			fileServer.ServeHTTP(w, r)
+		}
+		downloadDuration.Observe(time.Since(tsBegin).Seconds())
+	})
+}
+
+// listenAndServe serves handler over HTTPS and HTTP/3 at addr, or only over
+// HTTP/3 when l uses the quic protocol.
+func listenAndServe(ctx context.Context, l *listener, addr string, handler http.Handler) error {
+	quicOnly := l.Protocol == "quic"
 	// Load certs
 	var err error
-	kpr, err := keypair.NewKeypairReloader(certFile, keyFile)
+	kpr, err := keypair.NewKeypairReloader(l.Cert, l.Key)
 	if err != nil {
 		return err
 	}
@@ -75,6 +145,7 @@ func listenAndServe(addr, certFile, keyFile string, handler http.Handler, quicOn
 	httpServer := &http.Server{
 		Addr:      addr,
 		TLSConfig: config,
+		ConnState: trackConnState,
 	}
 
 	quicServer := &http3.Server{
@@ -88,32 +159,45 @@ func listenAndServe(addr, certFile, keyFile string, handler http.Handler, quicOn
 
 	httpServer.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !quicOnly {
-			quicServer.SetQuicHeaders(w.Header())
+			quicServer.SetQUICHeaders(w.Header())
 		}
 		handler.ServeHTTP(w, r)
 	})
+	var quicDrain drainTracker
+	quicServer.Handler = quicDrain.wrap(handler)
 
-	hErr := make(chan error)
+	hErr := make(chan error, 1)
 	if !quicOnly {
-		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
-		if err != nil {
-			return err
-		}
-		tcpConn, err := net.ListenTCP("tcp", tcpAddr)
+		tcpConn, err := listenTCP(addr)
 		if err != nil {
 			return err
 		}
 		defer tcpConn.Close()
 
-		tlsConn := tls.NewListener(tcpConn, config)
+		tcpConfig := config
+		if l.Mode == "relay" {
+			// let gRPC clients talk HTTP/2 to the relay, proxy mode keeps
+			// HTTP/1.1 as CONNECT needs to hijack the connection
+			tcpConfig = config.Clone()
+			tcpConfig.NextProtos = []string{"h2", "http/1.1"}
+			httpServer.TLSConfig = tcpConfig
+		}
+		tlsConn := tls.NewListener(tcpConn, tcpConfig)
 		defer tlsConn.Close()
 		go func() {
 			hErr <- httpServer.Serve(tlsConn)
 		}()
 	}
-	qErr := make(chan error)
+	// Accept the QUIC connections here instead of in quicServer.Serve to be
+	// able to count them.
+	quicListener, err := quic.ListenEarly(udpConn, http3.ConfigureTLSConfig(config), &quic.Config{Allow0RTT: true})
+	if err != nil {
+		return err
+	}
+	defer quicListener.Close()
+	qErr := make(chan error, 1)
 	go func() {
-		qErr <- quicServer.Serve(udpConn)
+		qErr <- quicServer.ServeListener(countingQUICListener{quicListener})
 	}()
 
 	select {
@@ -121,7 +205,33 @@ func listenAndServe(addr, certFile, keyFile string, handler http.Handler, quicOn
 		quicServer.Close()
 		return err
 	case err := <-qErr:
-		// Cannot close the HTTP server or wait for requests to complete properly :/
+		httpServer.Close()
 		return err
+	case <-ctx.Done():
+	}
+
+	// Stop accepting on both transports, then wait for the running requests.
+	// quic-go cannot drain by itself, so new HTTP/3 requests are refused
+	// until the in-flight ones are done.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	var hShutdownErr, qShutdownErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if hShutdownErr = httpServer.Shutdown(shutdownCtx); hShutdownErr != nil {
+			httpServer.Close()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		qShutdownErr = quicDrain.drain(shutdownCtx)
+		quicServer.Close()
+	}()
+	wg.Wait()
+	if hShutdownErr != nil || qShutdownErr != nil {
+		return errShutdownTimeout
 	}
+	return nil
 }
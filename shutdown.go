@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+)
+
+var (
+	errShutdownTimeout = errors.New("timed out draining in-flight requests")
+
+	partialUploads sync.Map
+)
+
+// drainTracker counts the requests being served so that a shutdown can wait
+// for them, it is needed for HTTP/3 as quic-go cannot drain on its own.
+type drainTracker struct {
+	wg sync.WaitGroup
+	// mu makes checking draining and adding to wg one step, no request is
+	// added once drain waits
+	mu       sync.Mutex
+	draining bool
+}
+
+func (t *drainTracker) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.mu.Lock()
+		if t.draining {
+			t.mu.Unlock()
+			w.Header().Set("Connection", "close")
+			http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		t.wg.Add(1)
+		t.mu.Unlock()
+		defer t.wg.Done()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// drain stops accepting new requests and waits for the running ones until
+// ctx expires.
+func (t *drainTracker) drain(ctx context.Context) error {
+	t.mu.Lock()
+	t.draining = true
+	t.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errShutdownTimeout
+	}
+}
+
+// serveUntilDone runs serve until it fails or ctx is cancelled, in the latter
+// case the server is shut down gracefully within --shutdownTimeout.
+func serveUntilDone(ctx context.Context, server *http.Server, serve func() error) error {
+	sErr := make(chan error, 1)
+	go func() {
+		sErr <- serve()
+	}()
+
+	select {
+	case err := <-sErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		server.Close()
+		return errShutdownTimeout
+	}
+	return nil
+}
+
+func trackPartialUpload(name string) {
+	partialUploads.Store(name, struct{}{})
+}
+
+func untrackPartialUpload(name string) {
+	partialUploads.Delete(name)
+}
+
+// removePartialUploads deletes the temporary files of uploads which were
+// interrupted by the shutdown.
+func removePartialUploads() {
+	partialUploads.Range(func(key, value any) bool {
+		name := key.(string)
+		if err := os.Remove(name); err == nil {
+			logStdout.Println("Removed partial upload", name)
+		}
+		partialUploads.Delete(key)
+		return true
+	})
+}
+
+// exitWithServeError reports why the servers stopped and exits with status 0
+// after a clean drain, 2 when in-flight requests had to be aborted and 1 on
+// any other error.
+func exitWithServeError(err error) {
+	removePartialUploads()
+	switch {
+	case err == nil || errors.Is(err, http.ErrServerClosed):
+		logStdout.Println("Shut down gracefully.")
+		os.Exit(0)
+	case errors.Is(err, errShutdownTimeout):
+		logStderr.Println("Shut down after", shutdownTimeout, ":", err)
+		os.Exit(2)
+	default:
+		logStderr.Fatal(err)
+	}
+}
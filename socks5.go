@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// SOCKS5 as of RFC 1928 with the username/password authentication of
+// RFC 1929. BIND is not supported.
+const (
+	socks5Version = 5
+
+	socks5AuthNone         = 0x00
+	socks5AuthPassword     = 0x02
+	socks5AuthUnacceptable = 0xff
+
+	socks5CmdConnect      = 0x01
+	socks5CmdUDPAssociate = 0x03
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5Succeeded           = 0x00
+	socks5GeneralFailure      = 0x01
+	socks5NotAllowed          = 0x02
+	socks5NetworkUnreachable  = 0x03
+	socks5HostUnreachable     = 0x04
+	socks5ConnectionRefused   = 0x05
+	socks5CommandNotSupported = 0x07
+	socks5AddrNotSupported    = 0x08
+
+	socks5HandshakeTimeout = 30 * time.Second
+	socks5UDPBufferSize    = 64 * 1024
+)
+
+var (
+	errSocks5Auth     = errors.New("socks5 authentication failed")
+	errSocks5AddrType = errors.New("unsupported socks address type")
+)
+
+// serveSocks5 accepts SOCKS5 clients on addr until ctx is cancelled, then
+// waits up to --shutdownTimeout for the open sessions.
+func serveSocks5(ctx context.Context, addr string) error {
+	ln, err := listenTCP(addr)
+	if err != nil {
+		return err
+	}
+	logStdout.Println("Starting socks5 proxy at", addr, ", please don't close it if you are not sure what it is doing.")
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		conns = make(map[net.Conn]struct{})
+	)
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return err
+		}
+		mu.Lock()
+		conns[conn] = struct{}{}
+		mu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveSocks5Conn(conn)
+			mu.Lock()
+			delete(conns, conn)
+			mu.Unlock()
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(shutdownTimeout):
+		mu.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		mu.Unlock()
+		return errShutdownTimeout
+	}
+}
+
+// socks5Session is what gets logged about one client connection.
+type socks5Session struct {
+	entry    *accessLogEntry
+	sent     int64
+	received int64
+}
+
+func serveSocks5Conn(conn net.Conn) {
+	defer conn.Close()
+	activeConnections.WithLabelValues("tcp").Inc()
+	defer activeConnections.WithLabelValues("tcp").Dec()
+
+	session := &socks5Session{entry: &accessLogEntry{
+		Time:     time.Now(),
+		Client:   stripPort(conn.RemoteAddr().String()),
+		Protocol: "socks5",
+		proto:    "SOCKS5",
+	}}
+	defer session.log()
+
+	if !isClientAllowed(conn.RemoteAddr().String()) {
+		logStderr.Printf("WARN: Socks5: client %s is not allowed\n", conn.RemoteAddr())
+		session.entry.Status = http.StatusForbidden
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+	user, err := socks5Handshake(conn)
+	if err != nil {
+		logStderr.Printf("WARN: Socks5: %s: %v\n", conn.RemoteAddr(), err)
+		session.entry.Status = http.StatusProxyAuthRequired
+		return
+	}
+	session.entry.User = user
+
+	cmd, target, err := readSocks5Request(conn)
+	if err != nil {
+		logStderr.Printf("WARN: Socks5: %s: %v\n", conn.RemoteAddr(), err)
+		session.entry.Status = http.StatusBadRequest
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	session.entry.URI = target
+
+	switch cmd {
+	case socks5CmdConnect:
+		session.entry.Method = "CONNECT"
+		logStdout.Printf("INFO: Socks5: %s CONNECT %s\n", dashIfEmpty(user), target)
+		socks5Connect(conn, target, session)
+	case socks5CmdUDPAssociate:
+		session.entry.Method = "UDP"
+		logStdout.Printf("INFO: Socks5: %s UDP ASSOCIATE %s\n", dashIfEmpty(user), target)
+		socks5UDPAssociate(conn, target, session)
+	default:
+		session.entry.Method = strconv.Itoa(int(cmd))
+		session.entry.Status = http.StatusNotImplemented
+		writeSocks5Reply(conn, socks5CommandNotSupported, nil)
+	}
+}
+
+func (s *socks5Session) log() {
+	entry := s.entry
+	if entry.Status == 0 {
+		entry.Status = http.StatusOK
+	}
+	// rejected before a command was read
+	entry.Method = ternaryOp(entry.Method == "", "-", entry.Method)
+	entry.URI = ternaryOp(entry.URI == "", "-", entry.URI)
+	entry.Bytes = s.sent
+	entry.Duration = float64(time.Since(entry.Time).Microseconds()) / 1000
+	requestsTotal.WithLabelValues("socks5", "socks5", strconv.Itoa(entry.Status)).Inc()
+	requestDuration.WithLabelValues("socks5", "socks5").Observe(time.Since(entry.Time).Seconds())
+	receivedBytes.WithLabelValues("socks5").Add(float64(s.received))
+	sentBytes.WithLabelValues("socks5").Add(float64(s.sent))
+	if accessLogger != nil {
+		writeAccessLog(entry)
+	}
+}
+
+// socks5Handshake negotiates the authentication method and returns the
+// authenticated user, proxy credentials are required whenever the HTTP proxy
+// would require them.
+func socks5Handshake(conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socks5Version {
+		return "", errors.New("unsupported socks version " + strconv.Itoa(int(header[0])))
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	wanted := byte(socks5AuthNone)
+	if proxyAuthRequired() {
+		wanted = socks5AuthPassword
+	}
+	offered := false
+	for _, m := range methods {
+		if m == wanted {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		conn.Write([]byte{socks5Version, socks5AuthUnacceptable})
+		return "", errors.New("no acceptable authentication method")
+	}
+	if _, err := conn.Write([]byte{socks5Version, wanted}); err != nil {
+		return "", err
+	}
+	if wanted == socks5AuthNone {
+		return "", nil
+	}
+
+	// RFC 1929: VER ULEN UNAME PLEN PASSWD
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	user := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(conn, header[:1]); err != nil {
+		return "", err
+	}
+	pass := make([]byte, header[0])
+	if _, err := io.ReadFull(conn, pass); err != nil {
+		return "", err
+	}
+	if !checkProxyCredential(string(user), string(pass)) {
+		conn.Write([]byte{1, 1})
+		return "", errSocks5Auth
+	}
+	_, err := conn.Write([]byte{1, 0})
+	return string(user), err
+}
+
+func readSocks5Request(conn net.Conn) (byte, string, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return 0, "", err
+	}
+	if header[0] != socks5Version {
+		return 0, "", errors.New("unsupported socks version " + strconv.Itoa(int(header[0])))
+	}
+	target, err := readSocks5Addr(conn)
+	if err != nil {
+		if errors.Is(err, errSocks5AddrType) {
+			writeSocks5Reply(conn, socks5AddrNotSupported, nil)
+		}
+		return 0, "", err
+	}
+	return header[1], target, nil
+}
+
+// readSocks5Addr reads ATYP DST.ADDR DST.PORT and returns it as host:port.
+func readSocks5Addr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		size := net.IPv4len
+		if atyp[0] == socks5AddrIPv6 {
+			size = net.IPv6len
+		}
+		ip := make(net.IP, size)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AddrDomain:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(r, n); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", errSocks5AddrType
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// appendSocks5Addr encodes addr as ATYP BND.ADDR BND.PORT, a nil addr is
+// sent as 0.0.0.0:0.
+func appendSocks5Addr(b []byte, addr net.Addr) []byte {
+	var (
+		ip   net.IP
+		port int
+	)
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil || ip == nil {
+		if ip4 == nil {
+			ip4 = net.IPv4zero.To4()
+		}
+		b = append(b, socks5AddrIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socks5AddrIPv6)
+		b = append(b, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+func writeSocks5Reply(conn net.Conn, rep byte, addr net.Addr) error {
+	_, err := conn.Write(appendSocks5Addr([]byte{socks5Version, rep, 0}, addr))
+	return err
+}
+
+// socks5DialError maps dial failures onto the SOCKS5 reply codes.
+func socks5DialError(err error) byte {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5ConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5NetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return socks5HostUnreachable
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return socks5HostUnreachable
+	}
+	return socks5GeneralFailure
+}
+
+func socks5Connect(conn net.Conn, target string, session *socks5Session) {
+	if connectActionFor(target) == connectBlock {
+		logStdout.Printf("INFO: Socks5: %s blocked CONNECT %s\n", dashIfEmpty(session.entry.User), target)
+		session.entry.Status = http.StatusForbidden
+		writeSocks5Reply(conn, socks5NotAllowed, nil)
+		return
+	}
+	if reason := checkHost(context.Background(), target); reason != "" {
+		logStderr.Printf("WARN: Socks5: denied %s %s CONNECT %s: %s\n", conn.RemoteAddr(), dashIfEmpty(session.entry.User), target, reason)
+		session.entry.Status = http.StatusForbidden
+		writeSocks5Reply(conn, socks5NotAllowed, nil)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), socks5HandshakeTimeout)
+	remote, err := dialUpstream(ctx, target)
+	cancel()
+	if err != nil {
+		logStderr.Println("ERR: Socks5:", err)
+		proxyUpstreamErrors.WithLabelValues("Socks5Connect").Inc()
+		session.entry.Status = http.StatusBadGateway
+		writeSocks5Reply(conn, socks5DialError(err), nil)
+		return
+	}
+	defer remote.Close()
+	if err = writeSocks5Reply(conn, socks5Succeeded, remote.LocalAddr()); err != nil {
+		return
+	}
+	session.sent, session.received = splice(conn, remote)
+}
+
+// socks5UDPAssociate relays datagrams for the client until its control
+// connection is closed. Datagrams are only accepted from the client host.
+func socks5UDPAssociate(conn net.Conn, target string, session *socks5Session) {
+	clientIP := conn.RemoteAddr().(*net.TCPAddr).IP
+	localIP := conn.LocalAddr().(*net.TCPAddr).IP
+	relay, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		logStderr.Println("ERR: Socks5:", err)
+		session.entry.Status = http.StatusInternalServerError
+		writeSocks5Reply(conn, socks5GeneralFailure, nil)
+		return
+	}
+	defer relay.Close()
+	// announce the address the client reached us at, the socket itself
+	// listens on all of them to be able to talk to any remote host
+	bound := &net.UDPAddr{IP: localIP, Port: relay.LocalAddr().(*net.UDPAddr).Port}
+	if err = writeSocks5Reply(conn, socks5Succeeded, bound); err != nil {
+		return
+	}
+
+	// the association ends with the TCP connection
+	go func() {
+		io.Copy(io.Discard, conn)
+		relay.Close()
+	}()
+
+	// the client may announce where it sends from, 0.0.0.0:0 if it does not know
+	var clientAddr *net.UDPAddr
+	if host, port, err := net.SplitHostPort(target); err == nil && port != "0" {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+			clientAddr, _ = net.ResolveUDPAddr("udp", target)
+		}
+	}
+
+	buf := make([]byte, socks5UDPBufferSize)
+	for {
+		n, from, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if from.IP.Equal(clientIP) && (clientAddr == nil || from.Port == clientAddr.Port) {
+			if clientAddr == nil {
+				clientAddr = from
+			}
+			session.received += int64(n)
+			socks5ForwardUDP(relay, buf[:n], session)
+			continue
+		}
+		if clientAddr == nil {
+			continue
+		}
+		// a reply from a remote host, RSV RSV FRAG ATYP ADDR PORT DATA
+		packet := appendSocks5Addr([]byte{0, 0, 0}, from)
+		packet = append(packet, buf[:n]...)
+		if _, err = relay.WriteToUDP(packet, clientAddr); err == nil {
+			session.sent += int64(n)
+		}
+	}
+}
+
+func socks5ForwardUDP(relay *net.UDPConn, packet []byte, session *socks5Session) {
+	// fragmented datagrams are not supported and dropped, as RFC 1928 allows
+	if len(packet) < 4 || packet[2] != 0 {
+		return
+	}
+	r := bytes.NewReader(packet[3:])
+	target, err := readSocks5Addr(r)
+	if err != nil {
+		return
+	}
+	if connectActionFor(target) == connectBlock {
+		logStdout.Printf("INFO: Socks5: %s blocked UDP %s\n", dashIfEmpty(session.entry.User), target)
+		return
+	}
+	if reason := checkHost(context.Background(), target); reason != "" {
+		logStderr.Printf("WARN: Socks5: denied %s UDP %s: %s\n", dashIfEmpty(session.entry.User), target, reason)
+		return
+	}
+	addr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		proxyUpstreamErrors.WithLabelValues("Socks5UDP").Inc()
+		return
+	}
+	if _, err = relay.WriteToUDP(packet[len(packet)-r.Len():], addr); err != nil {
+		proxyUpstreamErrors.WithLabelValues("Socks5UDP").Inc()
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// storage is what server mode serves files from and stores uploads into.
+// Names are slash separated and rooted, for example "/dir/file.txt".
+type storage interface {
+	// List returns the entries of directory name.
+	List(name string) ([]fs.FileInfo, error)
+	Stat(name string) (fs.FileInfo, error)
+	// OpenRange reads length bytes of name starting at offset, a negative
+	// length reads up to the end.
+	OpenRange(name string, offset, length int64) (io.ReadCloser, error)
+	// Create stores everything read from r as name, the content only
+	// becomes visible once it has been completely written.
+	Create(name string, r io.Reader) error
+	Rename(oldName, newName string) error
+	Delete(name string, recursive bool) error
+	Mkdir(name string) error
+	// Link makes newName share the content of oldName, as a hard link
+	// where possible and as a copy elsewhere.
+	Link(oldName, newName string) error
+}
+
+var (
+	serveStorage storage
+)
+
+// newStorage picks the backend from the --storage flag, the local serve
+// directory being the default.
+func newStorage(location string) (storage, error) {
+	if location == "" {
+		return localStorage{root: fileServePath}, nil
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "", "file":
+		return localStorage{root: filepath.FromSlash(u.Path)}, nil
+	case "s3":
+		return newS3Storage(u)
+	}
+	return nil, fmt.Errorf("unsupported storage %s", location)
+}
+
+type localStorage struct {
+	root string
+}
+
+func (s localStorage) path(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (s localStorage) List(name string) ([]fs.FileInfo, error) {
+	entries, err := os.ReadDir(s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]fs.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		infos = append(infos, fi)
+	}
+	return infos, nil
+}
+
+func (s localStorage) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(s.path(name))
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (s localStorage) OpenRange(name string, offset, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return limitedReadCloser{Reader: io.LimitReader(f, length), Closer: f}, nil
+}
+
+func (s localStorage) Create(name string, r io.Reader) error {
+	destFileName := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(destFileName), 0755); err != nil {
+		return err
+	}
+	tempFileName := filepath.Join(filepath.Dir(destFileName), "."+filepath.Base(destFileName)+"~")
+	resFile, err := os.Create(tempFileName)
+	if err != nil {
+		return err
+	}
+	trackPartialUpload(tempFileName)
+	defer untrackPartialUpload(tempFileName)
+
+	_, err = io.Copy(resFile, r)
+	resFile.Close()
+	if err != nil {
+		os.Remove(tempFileName)
+		return err
+	}
+	return os.Rename(tempFileName, destFileName)
+}
+
+func (s localStorage) Rename(oldName, newName string) error {
+	dest := s.path(newName)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	return os.Rename(s.path(oldName), dest)
+}
+
+func (s localStorage) Delete(name string, recursive bool) error {
+	if recursive {
+		if _, err := os.Lstat(s.path(name)); err != nil {
+			return err
+		}
+		return os.RemoveAll(s.path(name))
+	}
+	return os.Remove(s.path(name))
+}
+
+func (s localStorage) Mkdir(name string) error {
+	return os.MkdirAll(s.path(name), 0755)
+}
+
+func (s localStorage) Link(oldName, newName string) error {
+	src, dest := s.path(oldName), s.path(newName)
+	if srcInfo, err := os.Stat(src); err == nil {
+		// renaming a link onto another link of the same file is a no-op
+		if destInfo, err := os.Stat(dest); err == nil && os.SameFile(srcInfo, destInfo) {
+			return nil
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	tempFileName := filepath.Join(filepath.Dir(dest), "."+filepath.Base(dest)+"~")
+	os.Remove(tempFileName)
+	if err := os.Link(src, tempFileName); err != nil {
+		if err = copyFile(src, tempFileName); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tempFileName, dest)
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// storageFS adapts a storage to http.FileSystem for http.FileServer, paths
+// listed in hidden are neither listed nor served.
+type storageFS struct {
+	st     storage
+	hidden []string
+}
+
+type storageFile struct {
+	st      storage
+	name    string
+	fi      fs.FileInfo
+	hidden  []string
+	offset  int64
+	rc      io.ReadCloser
+	entries []fs.FileInfo
+	listed  bool
+}
+
+func (fsys storageFS) isHidden(name string) bool {
+	for _, h := range fsys.hidden {
+		if name == h || strings.HasPrefix(name, h+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (fsys storageFS) Open(name string) (http.File, error) {
+	name = path.Clean("/" + name)
+	if fsys.isHidden(name) {
+		return nil, fs.ErrNotExist
+	}
+	fi, err := fsys.st.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &storageFile{st: fsys.st, name: name, fi: fi, hidden: fsys.hidden}, nil
+}
+
+func (f *storageFile) Read(p []byte) (int, error) {
+	if f.fi.IsDir() {
+		return 0, errors.New("is a directory")
+	}
+	if f.rc == nil {
+		if f.offset >= f.fi.Size() {
+			return 0, io.EOF
+		}
+		rc, err := f.st.OpenRange(f.name, f.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		f.rc = rc
+	}
+	n, err := f.rc.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *storageFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.fi.Size()
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset != f.offset && f.rc != nil {
+		f.rc.Close()
+		f.rc = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *storageFile) Readdir(count int) ([]fs.FileInfo, error) {
+	if !f.listed {
+		entries, err := f.st.List(f.name)
+		if err != nil {
+			return nil, err
+		}
+		fsys := storageFS{hidden: f.hidden}
+		for _, e := range entries {
+			if !fsys.isHidden(path.Join(f.name, e.Name())) {
+				f.entries = append(f.entries, e)
+			}
+		}
+		f.listed = true
+	}
+	if count <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	count = min(count, len(f.entries))
+	entries := f.entries[:count]
+	f.entries = f.entries[count:]
+	return entries, nil
+}
+
+func (f *storageFile) Stat() (fs.FileInfo, error) {
+	return f.fi, nil
+}
+
+func (f *storageFile) Close() error {
+	if f.rc != nil {
+		return f.rc.Close()
+	}
+	return nil
+}
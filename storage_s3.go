@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3Storage keeps files as objects of an S3 compatible bucket, directories
+// being key prefixes with an optional empty "dir/" marker object.
+type s3Storage struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+func (fi s3FileInfo) Name() string       { return fi.name }
+func (fi s3FileInfo) Size() int64        { return fi.size }
+func (fi s3FileInfo) ModTime() time.Time { return fi.modTime }
+func (fi s3FileInfo) IsDir() bool        { return fi.isDir }
+func (fi s3FileInfo) Sys() any           { return nil }
+
+func (fi s3FileInfo) Mode() fs.FileMode {
+	if fi.isDir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+// newS3Storage connects to s3://bucket/prefix at --s3Endpoint, credentials
+// are taken from the usual AWS/MinIO environment variables or
+// ~/.aws/credentials.
+func newS3Storage(u *url.URL) (*s3Storage, error) {
+	if u.Host == "" {
+		return nil, errors.New("bucket is missing in storage " + u.String())
+	}
+	endpoint, err := url.Parse(s3Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Host == "" {
+		return nil, errors.New("invalid S3 endpoint " + s3Endpoint)
+	}
+	client, err := minio.New(endpoint.Host, &minio.Options{
+		Creds: credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.FileAWSCredentials{},
+		}),
+		Secure: endpoint.Scheme != "http",
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3Storage{
+		client: client,
+		bucket: u.Host,
+		prefix: strings.Trim(u.Path, "/"),
+	}, nil
+}
+
+func (s *s3Storage) key(name string) string {
+	return strings.TrimPrefix(path.Join(s.prefix, path.Clean("/"+name)), "/")
+}
+
+func (s *s3Storage) dirKey(name string) string {
+	key := s.key(name)
+	if key == "" {
+		return ""
+	}
+	return key + "/"
+}
+
+// s3Error maps missing objects onto fs.ErrNotExist so that callers can treat
+// every backend alike.
+func s3Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NotFound":
+		return fmt.Errorf("%w: %v", fs.ErrNotExist, err)
+	}
+	return err
+}
+
+// objects lists the objects below prefix, cancelling ctx stops the lister of
+// a channel which is not read to the end.
+func (s *s3Storage) objects(ctx context.Context, prefix string, recursive bool) <-chan minio.ObjectInfo {
+	return s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: recursive,
+	})
+}
+
+func (s *s3Storage) List(name string) ([]fs.FileInfo, error) {
+	prefix := s.dirKey(name)
+	var infos []fs.FileInfo
+	for obj := range s.objects(context.Background(), prefix, false) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		if obj.Key == prefix {
+			continue
+		}
+		isDir := strings.HasSuffix(obj.Key, "/")
+		infos = append(infos, s3FileInfo{
+			name:    path.Base(obj.Key),
+			size:    obj.Size,
+			modTime: obj.LastModified,
+			isDir:   isDir,
+		})
+	}
+	return infos, nil
+}
+
+func (s *s3Storage) Stat(name string) (fs.FileInfo, error) {
+	key := s.key(name)
+	if key != "" {
+		obj, err := s.client.StatObject(context.Background(), s.bucket, key, minio.StatObjectOptions{})
+		if err == nil {
+			return s3FileInfo{name: path.Base(key), size: obj.Size, modTime: obj.LastModified}, nil
+		}
+		if err = s3Error(err); !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for obj := range s.objects(ctx, s.dirKey(name), false) {
+		if obj.Err != nil {
+			return nil, s3Error(obj.Err)
+		}
+		return s3FileInfo{name: path.Base(path.Clean("/" + name)), isDir: true}, nil
+	}
+	if key == "" {
+		return s3FileInfo{name: "/", isDir: true}, nil
+	}
+	return nil, fs.ErrNotExist
+}
+
+func (s *s3Storage) OpenRange(name string, offset, length int64) (io.ReadCloser, error) {
+	opts := minio.GetObjectOptions{}
+	var err error
+	switch {
+	case length >= 0:
+		err = opts.SetRange(offset, offset+length-1)
+	case offset > 0:
+		err = opts.SetRange(offset, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	obj, err := s.client.GetObject(context.Background(), s.bucket, s.key(name), opts)
+	return obj, s3Error(err)
+}
+
+func (s *s3Storage) Create(name string, r io.Reader) error {
+	_, err := s.client.PutObject(context.Background(), s.bucket, s.key(name), r, -1, minio.PutObjectOptions{
+		PartSize: 16 * 1024 * 1024,
+	})
+	return s3Error(err)
+}
+
+// copyObject copies with a single request where possible, ComposeObject
+// switches to multipart copy which is needed for objects over 5GiB.
+func (s *s3Storage) copyObject(srcKey, destKey string, size int64) error {
+	dst := minio.CopyDestOptions{Bucket: s.bucket, Object: destKey}
+	src := minio.CopySrcOptions{Bucket: s.bucket, Object: srcKey}
+	var err error
+	if size > 5*1024*1024*1024 {
+		_, err = s.client.ComposeObject(context.Background(), dst, src)
+	} else {
+		_, err = s.client.CopyObject(context.Background(), dst, src)
+	}
+	return s3Error(err)
+}
+
+func (s *s3Storage) Link(oldName, newName string) error {
+	obj, err := s.client.StatObject(context.Background(), s.bucket, s.key(oldName), minio.StatObjectOptions{})
+	if err != nil {
+		return s3Error(err)
+	}
+	return s.copyObject(obj.Key, s.key(newName), obj.Size)
+}
+
+// Rename moves a directory by copying every object below it first and only
+// then deleting the originals. A failed copy stops the move, the copies made
+// so far are removed and the directory is left where it was.
+func (s *s3Storage) Rename(oldName, newName string) error {
+	fi, err := s.Stat(oldName)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		if err = s.Link(oldName, newName); err != nil {
+			return err
+		}
+		return s3Error(s.client.RemoveObject(context.Background(), s.bucket, s.key(oldName), minio.RemoveObjectOptions{}))
+	}
+
+	// there is no rename in S3, copy every object below the prefix instead
+	oldPrefix, newPrefix := s.dirKey(oldName), s.dirKey(newName)
+	var originals, copies []minio.ObjectInfo
+	for obj := range s.objects(context.Background(), oldPrefix, true) {
+		if obj.Err != nil {
+			return s3Error(obj.Err)
+		}
+		originals = append(originals, obj)
+	}
+	for _, obj := range originals {
+		destKey := newPrefix + strings.TrimPrefix(obj.Key, oldPrefix)
+		if err = s.copyObject(obj.Key, destKey, obj.Size); err != nil {
+			if rmErr := s.removeObjects(copies); rmErr != nil {
+				logStderr.Println("ERR: S3: removing the partial copy of", oldName+":", rmErr)
+			}
+			return err
+		}
+		copies = append(copies, minio.ObjectInfo{Key: destKey})
+	}
+	return s.removeObjects(originals)
+}
+
+// removeObjects deletes objs in batches and returns the first error.
+func (s *s3Storage) removeObjects(objs []minio.ObjectInfo) error {
+	ch := make(chan minio.ObjectInfo, len(objs))
+	for _, obj := range objs {
+		ch <- obj
+	}
+	close(ch)
+	return firstRemoveError(s.client.RemoveObjects(context.Background(), s.bucket, ch, minio.RemoveObjectsOptions{}))
+}
+
+// firstRemoveError reads the results of RemoveObjects to the end, minio-go
+// and the lister feeding it would block otherwise, and returns the first
+// error.
+func firstRemoveError(errs <-chan minio.RemoveObjectError) error {
+	var first error
+	for e := range errs {
+		if first == nil {
+			first = s3Error(e.Err)
+		}
+	}
+	return first
+}
+
+func (s *s3Storage) Delete(name string, recursive bool) error {
+	fi, err := s.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return s3Error(s.client.RemoveObject(context.Background(), s.bucket, s.key(name), minio.RemoveObjectOptions{}))
+	}
+	if !recursive {
+		entries, err := s.List(name)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return errors.New("directory is not empty")
+		}
+	}
+	return firstRemoveError(s.client.RemoveObjects(context.Background(), s.bucket, s.objects(context.Background(), s.dirKey(name), true), minio.RemoveObjectsOptions{}))
+}
+
+func (s *s3Storage) Mkdir(name string) error {
+	_, err := s.client.PutObject(context.Background(), s.bucket, s.dirKey(name), strings.NewReader(""), 0, minio.PutObjectOptions{})
+	return s3Error(err)
+}
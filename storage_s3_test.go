@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an in-memory stand-in for the part of the S3 API s3Storage uses,
+// like a MinIO server would answer it. It does not check signatures.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	// keys whose copy or removal fails
+	failCopy   map[string]bool
+	failRemove map[string]bool
+	modTime    time.Time
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects:    make(map[string][]byte),
+		uploads:    make(map[string]map[int][]byte),
+		failCopy:   make(map[string]bool),
+		failRemove: make(map[string]bool),
+		modTime:    time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+}
+
+type fakeS3Contents struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+}
+
+type fakeS3ListResult struct {
+	XMLName        xml.Name `xml:"ListBucketResult"`
+	Name           string
+	Prefix         string
+	KeyCount       int
+	MaxKeys        int
+	Delimiter      string
+	IsTruncated    bool
+	Contents       []fakeS3Contents
+	CommonPrefixes []struct{ Prefix string }
+}
+
+type fakeS3DeleteError struct {
+	Key     string
+	Code    string
+	Message string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	q := r.URL.Query()
+	switch {
+	case key == "" && q.Has("location"):
+		writeFakeS3XML(w, struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+		}{})
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, bucket, q.Get("prefix"), q.Get("delimiter"))
+	case key == "" && r.Method == http.MethodPost && q.Has("delete"):
+		f.removeObjects(w, r)
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		id := strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[id] = make(map[int][]byte)
+		writeFakeS3XML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: id})
+	case r.Method == http.MethodPut && q.Has("uploadId"):
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		b, _ := io.ReadAll(r.Body)
+		f.uploads[q.Get("uploadId")][n] = b
+		w.Header().Set("ETag", fmt.Sprintf(`"part%d"`, n))
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		parts := f.uploads[q.Get("uploadId")]
+		var numbers []int
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		var b []byte
+		for _, n := range numbers {
+			b = append(b, parts[n]...)
+		}
+		f.objects[key] = b
+		delete(f.uploads, q.Get("uploadId"))
+		writeFakeS3XML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: bucket, Key: key, ETag: `"done"`})
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		delete(f.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		src, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		_, srcKey, _ := strings.Cut(strings.TrimPrefix(src, "/"), "/")
+		b, ok := f.objects[srcKey]
+		if !ok {
+			writeFakeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if f.failCopy[srcKey] {
+			writeFakeS3Error(w, http.StatusForbidden, "AccessDenied")
+			return
+		}
+		f.objects[key] = append([]byte(nil), b...)
+		writeFakeS3XML(w, struct {
+			XMLName      xml.Name `xml:"CopyObjectResult"`
+			LastModified string
+			ETag         string
+		}{LastModified: f.modTime.Format(time.RFC3339), ETag: `"copy"`})
+	case r.Method == http.MethodPut:
+		b, _ := io.ReadAll(r.Body)
+		f.objects[key] = b
+		w.Header().Set("ETag", `"put"`)
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		b, ok := f.objects[key]
+		if !ok {
+			writeFakeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Last-Modified", f.modTime.Format(http.TimeFormat))
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		start, end := 0, len(b)-1
+		if rng, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes="); ok {
+			first, last, _ := strings.Cut(rng, "-")
+			start, _ = strconv.Atoi(first)
+			if last != "" {
+				end, _ = strconv.Atoi(last)
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(b)))
+			w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		}
+		if r.Method == http.MethodGet {
+			w.Write(b[start : end+1])
+		}
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeFakeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, bucket, prefix, delimiter string) {
+	result := fakeS3ListResult{Name: bucket, Prefix: prefix, MaxKeys: 1000, Delimiter: delimiter}
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				p := key[:len(prefix)+i+1]
+				if !seen[p] {
+					seen[p] = true
+					result.CommonPrefixes = append(result.CommonPrefixes, struct{ Prefix string }{p})
+				}
+				continue
+			}
+		}
+		result.Contents = append(result.Contents, fakeS3Contents{
+			Key:          key,
+			LastModified: f.modTime.Format(time.RFC3339),
+			ETag:         `"etag"`,
+			Size:         len(f.objects[key]),
+		})
+	}
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+	writeFakeS3XML(w, result)
+}
+
+func (f *fakeS3) removeObjects(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Object []struct{ Key string }
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFakeS3Error(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+	result := struct {
+		XMLName xml.Name `xml:"DeleteResult"`
+		Deleted []struct{ Key string }
+		Error   []fakeS3DeleteError
+	}{}
+	for _, obj := range req.Object {
+		if f.failRemove[obj.Key] {
+			result.Error = append(result.Error, fakeS3DeleteError{Key: obj.Key, Code: "AccessDenied", Message: "Access Denied"})
+			continue
+		}
+		delete(f.objects, obj.Key)
+		result.Deleted = append(result.Deleted, struct{ Key string }{obj.Key})
+	}
+	writeFakeS3XML(w, result)
+}
+
+func writeFakeS3XML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
+
+func writeFakeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: code})
+}
+
+func newTestS3Storage(t *testing.T) (*s3Storage, *fakeS3) {
+	t.Helper()
+	// anonymous requests, minio-go signs streamed uploads in chunks otherwise
+	for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY", "AWS_SECRET_KEY", "MINIO_ACCESS_KEY", "MINIO_SECRET_KEY", "MINIO_ROOT_USER", "MINIO_ROOT_PASSWORD"} {
+		t.Setenv(name, "")
+	}
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", t.TempDir()+"/credentials")
+	fake := newFakeS3()
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	saved := s3Endpoint
+	s3Endpoint = srv.URL
+	t.Cleanup(func() { s3Endpoint = saved })
+	u, _ := url.Parse("s3://bucket/prefix")
+	st, err := newS3Storage(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st, fake
+}
+
+func createS3Files(t *testing.T, st *s3Storage, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		if err := st.Create(name, strings.NewReader(content)); err != nil {
+			t.Fatalf("Create %s: %v", name, err)
+		}
+	}
+}
+
+func readS3File(t *testing.T, st *s3Storage, name string, offset, length int64) string {
+	t.Helper()
+	rc, err := st.OpenRange(name, offset, length)
+	if err != nil {
+		t.Fatalf("OpenRange %s: %v", name, err)
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("reading %s: %v", name, err)
+	}
+	return string(b)
+}
+
+func listS3Names(t *testing.T, st *s3Storage, name string) []string {
+	t.Helper()
+	infos, err := st.List(name)
+	if err != nil {
+		t.Fatalf("List %s: %v", name, err)
+	}
+	var names []string
+	for _, fi := range infos {
+		names = append(names, fi.Name()+map[bool]string{true: "/"}[fi.IsDir()])
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestS3StorageFiles(t *testing.T) {
+	st, fake := newTestS3Storage(t)
+	createS3Files(t, st, map[string]string{
+		"/dir/a.txt":     "hello world",
+		"/dir/sub/b.txt": "bee",
+		"/top.txt":       "top",
+	})
+	if _, ok := fake.objects["prefix/dir/a.txt"]; !ok {
+		t.Fatalf("objects are not stored below the prefix: %v", fake.objects)
+	}
+
+	fi, err := st.Stat("/dir/a.txt")
+	if err != nil || fi.IsDir() || fi.Size() != 11 {
+		t.Fatalf("Stat file = %v, %v", fi, err)
+	}
+	if fi, err = st.Stat("/dir"); err != nil || !fi.IsDir() {
+		t.Fatalf("Stat dir = %v, %v", fi, err)
+	}
+	if _, err = st.Stat("/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Stat missing = %v, want fs.ErrNotExist", err)
+	}
+
+	if got := strings.Join(listS3Names(t, st, "/"), " "); got != "dir/ top.txt" {
+		t.Errorf("List / = %s", got)
+	}
+	if got := strings.Join(listS3Names(t, st, "/dir"), " "); got != "a.txt sub/" {
+		t.Errorf("List /dir = %s", got)
+	}
+
+	if got := readS3File(t, st, "/dir/a.txt", 0, -1); got != "hello world" {
+		t.Errorf("whole file = %q", got)
+	}
+	if got := readS3File(t, st, "/dir/a.txt", 6, -1); got != "world" {
+		t.Errorf("from offset 6 = %q", got)
+	}
+	if got := readS3File(t, st, "/dir/a.txt", 0, 5); got != "hello" {
+		t.Errorf("first 5 bytes = %q", got)
+	}
+}
+
+func TestS3StorageRename(t *testing.T) {
+	st, fake := newTestS3Storage(t)
+	createS3Files(t, st, map[string]string{
+		"/dir/a.txt":     "a",
+		"/dir/sub/b.txt": "b",
+		"/file.txt":      "f",
+	})
+
+	if err := st.Rename("/file.txt", "/renamed.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readS3File(t, st, "/renamed.txt", 0, -1); got != "f" {
+		t.Errorf("renamed file = %q", got)
+	}
+	if _, err := st.Stat("/file.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat old file = %v, want fs.ErrNotExist", err)
+	}
+
+	fake.failCopy["prefix/dir/sub/b.txt"] = true
+	if err := st.Rename("/dir", "/moved"); err == nil {
+		t.Fatal("Rename succeeded with a failing copy")
+	}
+	if _, err := st.Stat("/moved"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("a failed Rename left a partial copy: %v", fake.objects)
+	}
+	if got := strings.Join(listS3Names(t, st, "/dir"), " "); got != "a.txt sub/" {
+		t.Errorf("a failed Rename changed the source: %s", got)
+	}
+
+	delete(fake.failCopy, "prefix/dir/sub/b.txt")
+	if err := st.Rename("/dir", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readS3File(t, st, "/moved/sub/b.txt", 0, -1); got != "b" {
+		t.Errorf("moved file = %q", got)
+	}
+	if _, err := st.Stat("/dir"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat old dir = %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestS3StorageDelete(t *testing.T) {
+	st, fake := newTestS3Storage(t)
+	createS3Files(t, st, map[string]string{
+		"/dir/a.txt":     "a",
+		"/dir/b.txt":     "b",
+		"/dir/sub/c.txt": "c",
+		"/file.txt":      "f",
+	})
+
+	if err := st.Delete("/file.txt", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Stat("/file.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat deleted file = %v", err)
+	}
+	if err := st.Delete("/dir", false); err == nil {
+		t.Fatal("deleted a directory which is not empty")
+	}
+
+	fake.failRemove["prefix/dir/a.txt"] = true
+	fake.failRemove["prefix/dir/b.txt"] = true
+	if err := st.Delete("/dir", true); err == nil {
+		t.Fatal("Delete succeeded although objects could not be removed")
+	}
+	if _, err := st.Stat("/dir/sub/c.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("the removable objects were not removed: %v", err)
+	}
+
+	clear(fake.failRemove)
+	if err := st.Delete("/dir", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Stat("/dir"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat deleted dir = %v", err)
+	}
+}
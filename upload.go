@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,31 +18,97 @@ func newfileUploadRequest(uri string, params map[string]string, paramName, fileP
 	if err != nil {
 		return nil, 0, err
 	}
+	if uploadEncoding != "" {
+		return newCompressedUploadRequest(uri, params, paramName, file)
+	}
 	defer file.Close()
 
 	body := &bytes.Buffer{}
 	writer := multipart.NewWriter(body)
-	part, err := writer.CreateFormFile(paramName, filepath.Base(filePath))
+	length, err := writeUploadForm(writer, params, paramName, file)
 	if err != nil {
 		return nil, 0, err
 	}
-	length, err := io.Copy(part, file)
+	req, err := http.NewRequest("POST", uri, body)
 	if err != nil {
 		return nil, 0, err
 	}
+	SetRequestHeader(req)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req, length, nil
+}
 
-	for key, val := range params {
-		_ = writer.WriteField(key, val)
+// newCompressedUploadRequest encodes the form while the request is sent, so
+// that neither the form nor its compressed copy are held in memory. The
+// request takes over file.
+func newCompressedUploadRequest(uri string, params map[string]string, paramName string, file *os.File) (*http.Request, int64, error) {
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
 	}
-	err = writer.Close()
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest("POST", uri, pr)
 	if err != nil {
+		file.Close()
 		return nil, 0, err
 	}
-
-	req, err := http.NewRequest("POST", uri, body)
+	enc := encoderPools[uploadEncoding].Get().(encoder)
+	enc.Reset(pw)
+	writer := multipart.NewWriter(enc)
+	go func() {
+		defer file.Close()
+		_, err := writeUploadForm(writer, params, paramName, file)
+		if err == nil {
+			err = enc.Close()
+		}
+		enc.Reset(nil)
+		encoderPools[uploadEncoding].Put(enc)
+		// a nil error ends the body, anything else fails the request
+		pw.CloseWithError(err)
+	}()
 	SetRequestHeader(req)
 	req.Header.Set("Content-Type", writer.FormDataContentType())
-	return req, length, err
+	req.Header.Set("Content-Encoding", uploadEncoding)
+	return req, fi.Size(), nil
+}
+
+// writeUploadForm writes file and params as a multipart form and returns the
+// size of the file.
+func writeUploadForm(writer *multipart.Writer, params map[string]string, paramName string, file *os.File) (int64, error) {
+	part, err := writer.CreateFormFile(paramName, filepath.Base(file.Name()))
+	if err != nil {
+		return 0, err
+	}
+	length, err := io.Copy(part, file)
+	if err != nil {
+		return 0, err
+	}
+
+	for key, val := range params {
+		_ = writer.WriteField(key, val)
+	}
+	return length, writer.Close()
+}
+
+// uploadEncoding is the Content-Encoding of uploads with --compress.
+var uploadEncoding string
+
+// chooseUploadEncoding picks the coding of --compress uploads from the
+// Accept-Encoding the server answers with, probing uri unless its headers
+// are already known. gzip is tried when the server cannot be asked.
+func chooseUploadEncoding(uri string, headers http.Header) string {
+	if headers == nil {
+		var err error
+		if headers, err = getHTTPResponseHeader(uri); err != nil {
+			return "gzip"
+		}
+	}
+	if encoding := negotiateEncoding(headers.Get("Accept-Encoding"), uploadEncodings); encoding != "" {
+		return encoding
+	}
+	logStderr.Println("WARN: the server does not take compressed uploads, sending them as they are")
+	return ""
 }
 
 func uploadFileRequest(uri string, filePath string, isHTTP3 bool) error {
@@ -50,11 +117,33 @@ func uploadFileRequest(uri string, filePath string, isHTTP3 bool) error {
 		"author":      "CUBE SA",
 		"description": fmt.Sprintf("file %s uploaded by CUBE SA", filepath.Base(filePath)),
 	}
+	var hash string
+	if dedup {
+		var err error
+		if hash, err = fileSHA256(filePath); err != nil {
+			logStderr.Println(err)
+			return err
+		}
+		linked, err := linkExistingBlobRequest(uri, filePath, hash, isHTTP3)
+		if err != nil {
+			logStderr.Println(err)
+		}
+		if linked {
+			return nil
+		}
+	}
 	request, totalSent, err := newfileUploadRequest(uri, extraParams, uploadFormFileName, filePath)
 	if err != nil {
 		logStderr.Println(err)
 		return err
 	}
+	if hash != "" {
+		request.Header.Set(contentHashHeader, hash)
+	}
+	var encodedSize atomic.Int64
+	if uploadEncoding != "" {
+		request.Body = countingReadCloser{ReadCloser: request.Body, counter: &encodedSize}
+	}
 	client := getHTTPClient(isHTTP3)
 	tsBegin := time.Now()
 	resp, err := client.Do(request)
@@ -71,8 +160,11 @@ func uploadFileRequest(uri string, filePath string, isHTTP3 bool) error {
 	}
 	tsEnd := time.Now()
 	tsCost := tsEnd.Sub(tsBegin)
-	speed := totalSent * 1000 / int64(tsCost/time.Millisecond)
+	speed := bytesPerSecond(totalSent, tsCost)
 	logs := englishPrinter.Sprintf("\rsent %d bytes in %+v at %d B/s, received response: %s\n", totalSent, tsCost, speed, string(body))
+	if uploadEncoding != "" {
+		logs = englishPrinter.Sprintf("\rsent %d bytes as %d bytes of %s in %+v at %d B/s, received response: %s\n", totalSent, encodedSize.Load(), uploadEncoding, tsCost, speed, string(body))
+	}
 	logStdout.Println(logs)
 	return nil
 }
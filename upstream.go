@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	routeDirect   = "direct"
+	routeUpstream = "upstream"
+)
+
+// upstreamRule forces the destinations matching pattern to be reached
+// directly or through the upstream proxy, regardless of NO_PROXY.
+type upstreamRule struct {
+	pattern hostPattern
+	route   string
+}
+
+var (
+	upstreamRules []upstreamRule
+	upstreamURL   *url.URL
+	upstreamFunc  func(*url.URL) (*url.URL, error)
+)
+
+// loadUpstream sets up routing through proxyURL, which is --proxy in the
+// client modes and --upstreamProxy in proxy and socks5 mode. Without it the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables apply.
+func loadUpstream(proxyURL string) error {
+	for _, s := range proxyRuleSpecs {
+		pattern, route, ok := strings.Cut(s, "=")
+		if !ok || (route != routeDirect && route != routeUpstream) {
+			return fmt.Errorf("invalid proxy rule %s, expected <host pattern>=<direct|upstream>", s)
+		}
+		p, err := parseHostPattern(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid proxy rule %s: %w", s, err)
+		}
+		upstreamRules = append(upstreamRules, upstreamRule{pattern: p, route: route})
+	}
+
+	cfg := httpproxy.FromEnvironment()
+	if proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return err
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return fmt.Errorf("unsupported proxy %s, candidates: http://, https://, socks5://", proxyURL)
+		}
+		cfg.HTTPProxy = proxyURL
+		cfg.HTTPSProxy = proxyURL
+		upstreamURL = u
+	} else if env := ternaryOp(cfg.HTTPSProxy != "", cfg.HTTPSProxy, cfg.HTTPProxy); env != "" {
+		upstreamURL, _ = url.Parse(env)
+	}
+	upstreamFunc = cfg.ProxyFunc()
+	return nil
+}
+
+// upstreamFor returns the proxy to reach u through, nil means direct.
+func upstreamFor(u *url.URL) (*url.URL, error) {
+	for _, rule := range upstreamRules {
+		if rule.pattern.match(u.Host) {
+			if rule.route == routeDirect {
+				return nil, nil
+			}
+			return upstreamURL, nil
+		}
+	}
+	if upstreamFunc == nil {
+		return nil, nil
+	}
+	return upstreamFunc(u)
+}
+
+// upstreamProxy is meant to be used as http.Transport.Proxy.
+func upstreamProxy(req *http.Request) (*url.URL, error) {
+	return upstreamFor(req.URL)
+}
+
+// usesUpstream reports whether requests to uri go through a proxy, those
+// cannot be upgraded to HTTP/3.
+func usesUpstream(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+	proxyURL, _ := upstreamFor(u)
+	return proxyURL != nil
+}
+
+// dialUpstream opens a TCP connection to addr, through the upstream proxy
+// when the routing says so.
+func dialUpstream(ctx context.Context, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	proxyURL, err := upstreamFor(&url.URL{Scheme: "https", Host: addr})
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL == nil {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		d, err := proxy.FromURL(proxyURL, dialer)
+		if err != nil {
+			return nil, err
+		}
+		return d.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	case "http", "https":
+		return dialHTTPConnect(ctx, dialer, proxyURL, addr)
+	}
+	return nil, fmt.Errorf("unsupported proxy %s", proxyURL.Redacted())
+}
+
+// dialHTTPConnect asks the HTTP proxy at proxyURL for a tunnel to addr.
+func dialHTTPConnect(ctx context.Context, dialer *net.Dialer, proxyURL *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), ternaryOp(proxyURL.Scheme == "https", "443", "80"))
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname(), InsecureSkipVerify: insecureSkipVerify})
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := proxyURL.User; u != nil {
+		pass, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+pass)))
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if err = req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.New("upstream proxy refused CONNECT " + addr + ": " + resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn returns what was read ahead while parsing the CONNECT
+// response before reading from the connection again.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}